@@ -0,0 +1,45 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// arraySeparators resolves Options.ArrayColumns against a source's columns,
+// returning each column's separator by index, or nil when there are none.
+// Like a date column, a missing array column is an error.
+func arraySeparators(separators map[string]string, columns columnIndex) ([]string, error) {
+	if len(separators) == 0 {
+		return nil, nil
+	}
+	bySeparator := make([]string, len(columns.keys))
+	for name, sep := range separators {
+		if sep == "" {
+			return nil, fmt.Errorf("array column %q has an empty separator", name)
+		}
+		i, err := columns.lookup("array", name)
+		if err != nil {
+			return nil, err
+		}
+		bySeparator[i] = sep
+	}
+	return bySeparator, nil
+}
+
+// splitArray splits an array column's cell into its elements. An empty cell
+// is an empty list, or null with opts.EmptyArrayNull.
+func splitArray(cell, sep string, opts Options) interface{} {
+	if cell == "" {
+		if opts.EmptyArrayNull {
+			return nil
+		}
+		return []string{}
+	}
+	items := strings.Split(cell, sep)
+	if opts.Trim {
+		for i, item := range items {
+			items[i] = strings.TrimSpace(item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,1601 @@
+// Package converter turns CSV input into JSON using a pool of worker
+// goroutines.
+package converter
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	xunicode "golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"golang.org/x/time/rate"
+)
+
+// Output formats accepted in Options.Format.
+const (
+	// FormatJSONL writes one compact JSON object per line.
+	FormatJSONL = "jsonl"
+	// FormatJSONArray writes a single JSON array, one element per line.
+	FormatJSONArray = "json-array"
+	// FormatCSV writes the transformed rows back out as CSV, with columns
+	// in the order of the first input's header.
+	FormatCSV = "csv"
+	// FormatYAML writes each row as a YAML document, or as an item of one
+	// YAML list when Options.YAMLSequence is set.
+	FormatYAML = "yaml"
+)
+
+// Key casing modes accepted in Options.KeyCase.
+const (
+	KeyCaseLower    = "lower"
+	KeyCaseOriginal = "original"
+	KeyCaseUpper    = "upper"
+	KeyCaseSnake    = "snake"
+)
+
+// Options controls how Convert parses and writes rows. The zero value
+// converts comma-separated input to JSON Lines using one worker per CPU.
+type Options struct {
+	// Workers is the number of goroutines writing rows. Zero means
+	// runtime.NumCPU().
+	Workers int
+	// Delimiter is the field separator. Zero means a comma.
+	Delimiter rune
+	// DetectDelimiter picks each source's delimiter from its header line,
+	// in place of Delimiter, as whichever of comma, tab, semicolon and pipe
+	// appears there most often outside quotes; a line with none of them is
+	// taken as comma-separated. DelimiterDetected, if set, is told the
+	// choice.
+	DetectDelimiter   bool
+	DelimiterDetected func(source string, delimiter rune)
+	// LazyQuotes tolerates stray quotes inside fields instead of treating
+	// the row as malformed.
+	LazyQuotes bool
+	// TrimLeadingSpace ignores whitespace after each delimiter.
+	TrimLeadingSpace bool
+	// MaxFieldSize, if positive, is the largest field in bytes. Rows with a
+	// larger field are skipped as malformed, or abort the conversion with
+	// Strict. A record whose input grows far past what its columns could
+	// hold aborts the conversion before it is read into memory whole.
+	MaxFieldSize int
+	// Widths, if set, reads fixed-width input: each line is cut into
+	// fields of these widths in characters instead of being parsed as CSV.
+	// Fields keep their padding unless Trim is set. Delimiter, LazyQuotes
+	// and SplitRegex are ignored.
+	Widths []int
+	// Comment, if set, marks comment lines: a line starting with it is
+	// skipped, unless it continues a quoted field. It must differ from
+	// Delimiter.
+	Comment rune
+	// SplitRegex, if set, splits each line of the input on its matches
+	// instead of parsing it as CSV, for separators such as "||" that
+	// Delimiter can't express. Quoting isn't recognized, so fields can't
+	// contain the separator or line breaks; Delimiter and LazyQuotes are
+	// ignored.
+	SplitRegex *regexp.Regexp
+	// Encoding is the IANA name of the input's character set, such as
+	// "ISO-8859-1" or "windows-1252". Empty means UTF-8.
+	Encoding string
+	// Format is FormatJSONL, FormatJSONArray, FormatCSV or FormatYAML.
+	// Empty means FormatJSONL.
+	Format string
+	// Indent, if set, pretty-prints FormatJSONL and FormatJSONArray rows,
+	// indenting each level with it, e.g. two spaces. FormatJSONL rows then
+	// span several lines, so the output is a stream of JSON objects rather
+	// than JSON Lines.
+	Indent string
+	// PreserveOrder writes the keys of FormatJSONL and FormatJSONArray
+	// rows in header order, followed by keys such as SourceKey, instead of
+	// sorted. Objects built by NestSeparator keep their keys sorted.
+	PreserveOrder bool
+	// YAMLSequence writes FormatYAML output as a single list instead of a
+	// stream of documents.
+	YAMLSequence bool
+	// BatchSize, if positive, groups FormatJSONL output into JSON arrays of
+	// up to this many rows, one array per line.
+	BatchSize int
+	// ActionLine, if set, is written on a line of its own before every
+	// FormatJSONL row, as the Elasticsearch bulk API expects, for example
+	// {"index":{}}. It can't be combined with BatchSize.
+	ActionLine string
+	// Sink, if set, receives every row in place of the encoded output, so
+	// the writer passed to Convert is unused. It is called from a single
+	// goroutine with the row's top-level keys in header order; an error
+	// aborts the conversion. Format and the options that shape its output
+	// don't apply.
+	Sink func(fields []string, row map[string]interface{}) error
+	// Header, if set, is called by the reader once a source's header has
+	// been read, with the top-level keys its rows can have in header order,
+	// as a Sink receives them, so that a Sink can describe an output that
+	// gets no rows. With ConcurrentSources, calls for different sources may
+	// overlap.
+	Header func(source string, fields []string)
+	// Trailer, if set, is called once every row has been written, and the
+	// object it returns is written after them as one more record, such as
+	// the last element of a JSON array or a final YAML document. It is not
+	// counted as a row, and nothing is written when the conversion fails or
+	// is cancelled. FormatCSV, batching, an action line, split rows and a
+	// sink can't take a trailer.
+	Trailer func(stats Stats) map[string]interface{}
+	// SplitRows, if positive, limits each output part to this many rows.
+	// The first part goes to the writer given to Convert; NextPart is then
+	// called with 1, 2, ... for each following part, and must be set.
+	// Closing finished parts is left to the caller.
+	SplitRows int
+	NextPart  func(part int) (io.Writer, error)
+	// PartitionBy, if set, sends each row to an output of its own for its
+	// value of this top-level key, so that rows sharing a value end up
+	// together; the writer given to Convert is unused. OpenPartition is
+	// called with the value, as it would be written to CSV and empty when
+	// missing or null, the first time it is seen, and must be set. Every
+	// partition gets the format's full framing. Closing the partitions is
+	// left to the caller. It can't be combined with split rows, a sink or
+	// a trailer.
+	PartitionBy   string
+	OpenPartition func(value string) (io.Writer, error)
+	// Rate, if positive, caps the rows encoded per second across all
+	// workers, so that a rate-limited downstream isn't overwhelmed. Up to
+	// one second's worth of rows may pass in a burst.
+	Rate float64
+	// QueueSize is the number of parsed rows that can wait for a worker,
+	// and of encoded rows that can wait for the writer, so that reading
+	// need not stall on every slow row. Each queued row is held in memory.
+	// Zero means four per worker.
+	QueueSize int
+	// Ordered writes rows in input order instead of completion order.
+	Ordered bool
+	// ConcurrentSources reads several sources at once, up to one per
+	// worker, instead of one after another, merging their rows into the
+	// output as they come. Rows from different sources interleave, though
+	// with Ordered each source's rows keep their order. Which row DedupOn
+	// keeps, and which rows a seeded Sample keeps, then vary between runs.
+	ConcurrentSources bool
+	// Trim removes leading and trailing whitespace from header names and
+	// cell values.
+	Trim bool
+	// NullValues lists cell values, such as "NULL" or "\\N", written as JSON
+	// null. Include "" to treat empty cells as null.
+	NullValues []string
+	// NullCaseInsensitive matches NullValues regardless of case.
+	NullCaseInsensitive bool
+	// OmitEmpty leaves the key of an empty cell out of its row instead of
+	// writing an empty string. It takes precedence over a "" in NullValues;
+	// missing trailing fields are still written as null.
+	OmitEmpty bool
+	// InferTypes emits integers, floats and booleans as JSON scalars
+	// instead of strings.
+	InferTypes bool
+	// StringColumns lists columns, named as for Select, whose values stay
+	// strings when InferTypes is set.
+	StringColumns []string
+	// NoHeader treats every record as data. Keys are taken from Headers,
+	// or generated as col1, col2, ... when Headers is empty.
+	NoHeader bool
+	// Headers names the columns, replacing the input's header row unless
+	// NoHeader is set. Replacing a header row requires the same number of
+	// names; with NoHeader, records of a different width are reported like
+	// any other mismatch.
+	Headers []string
+	// KeyCase is how header names are turned into keys: KeyCaseLower,
+	// KeyCaseOriginal, KeyCaseUpper or KeyCaseSnake. Empty means KeyCaseLower.
+	KeyCase string
+	// ValueCase, if KeyCaseLower or KeyCaseUpper, changes the case of
+	// string values, including the items of array columns. Values inferred
+	// as numbers or booleans, nulls and DateColumns are left as they are.
+	ValueCase string
+	// SkipRows discards this many records before the header is read.
+	SkipRows int
+	// Limit stops reading after this many rows. Zero means no limit.
+	Limit int
+	// Select, if set, limits each row to these columns. Names are matched
+	// after the KeyCase transform, and naming a column missing from the
+	// header is an error.
+	Select []string
+	// Positions, if set, limits each row to the columns at these positions
+	// in the header, counting from 1, whatever their names. Combined with
+	// Select, a column either includes is kept. A position past the end of
+	// the header is an error.
+	Positions []int
+	// Exclude drops these columns from each row. It is applied after
+	// Select and matched the same way.
+	Exclude []string
+	// Rename maps column names, matched after the KeyCase transform, to the
+	// keys used in the output. Select and Exclude refer to the original
+	// names. A missing column is reported through Warn, or is an error when
+	// Strict is set.
+	Rename map[string]string
+	// NestSeparator, if set, splits keys on this string and builds nested
+	// objects, so "address.city" becomes {"address":{"city":...}} with ".".
+	NestSeparator string
+	// DateColumns maps column names, matched like Schema columns, to a
+	// time.Parse layout such as "02/01/2006". Matching cells are rewritten
+	// as RFC 3339; cells that don't match are reported through Warn and
+	// kept as they are, or their rows are left out when SkipInvalidDates is
+	// set. With Strict an invalid date aborts the conversion.
+	DateColumns      map[string]string
+	SkipInvalidDates bool
+	// ArrayColumns maps column names, matched like DateColumns, to a
+	// separator their cells are split on, so that "a;b;c" becomes the list
+	// ["a","b","c"]. Elements are always strings. An empty cell becomes an
+	// empty list, or null when EmptyArrayNull is set.
+	ArrayColumns   map[string]string
+	EmptyArrayNull bool
+	// Where lists conditions a row must all pass to be converted; other
+	// rows are counted as filtered and left out. Columns are matched like
+	// DateColumns.
+	Where []Condition
+	// Transforms rewrite the values of columns, in order; see Transform.
+	// Columns are matched like DateColumns.
+	Transforms []Transform
+	// Sample, if between 0 and 1, keeps each row passing Where with that
+	// probability, so 0.01 converts about 1% of them. Seed seeds the random
+	// choice for a reproducible sample; zero means a different sample each
+	// run.
+	Sample float64
+	Seed   int64
+	// DedupOn, if set, names columns, matched like DateColumns, whose
+	// values together identify a row; a row repeating the values of an
+	// earlier one, in any source, is counted as a duplicate and left out.
+	// Every distinct key is held in memory until the conversion ends.
+	DedupOn []string
+	// Schema, if set, is checked against every row. Rows that fail are
+	// reported through Warn and left out, or abort the conversion when
+	// Strict is set.
+	Schema *Schema
+	// RequireColumns lists columns each source's header must have, named as
+	// for Select. A source missing any of them fails before its rows are
+	// read.
+	RequireColumns []string
+	// StrictColumns also fails a source whose header has columns that
+	// RequireColumns doesn't list, so the header must be exactly those
+	// columns, in any order.
+	StrictColumns bool
+	// Strict makes any malformed row, including one whose field count
+	// differs from the header, abort the conversion. Otherwise such rows
+	// are reported through Warn and skipped or padded.
+	Strict bool
+	// OverflowKey, if set, collects fields beyond the header's width into a
+	// list under this key. Otherwise the extra fields are dropped.
+	OverflowKey string
+	// SourceKey, if set, adds the name of the row's source under this key.
+	SourceKey string
+	// LineKey, if set, adds the row's line number under this key: 1 for
+	// the first data row, not counting the header or skipped rows.
+	LineKey string
+	// HashKey, if set, adds a hex SHA-256 digest of the row under this key,
+	// computed from the row's JSON encoding with its keys sorted once every
+	// other key has been added, so equal rows get equal hashes whatever the
+	// worker or output order.
+	HashKey string
+	// AddFields are added to every row, after the CSV columns. A Value of
+	// FieldLine or FieldSource is replaced by the row's line number or
+	// source name.
+	AddFields []Field
+	// Warn, if set, is called with the source name, line number (zero for
+	// the header) and a description of each
+	// recoverable problem found in the input, such as a row whose field
+	// count differs from the header.
+	Warn func(source string, line int, msg string)
+	// Reject, if set, is called by the reader with each row left out for
+	// being malformed or failing the Schema, along with its fields as read
+	// (possibly partial for a malformed row) and the reason.
+	Reject func(source string, line int, record []string, reason string)
+	// Progress, if set, is called by the reader after each row is queued.
+	Progress func()
+}
+
+// Field is a key and value added to every row by Options.AddFields.
+type Field struct {
+	Key   string
+	Value string
+}
+
+// Placeholder values for a Field.
+const (
+	FieldLine   = "__line__"
+	FieldSource = "__source__"
+)
+
+// Stats summarizes a finished conversion.
+type Stats struct {
+	// Read is the number of data rows passed on to be written: those parsed
+	// from the input less the ones counted as Skipped, Invalid, Filtered or
+	// Duplicates. Limit caps this count.
+	Read int
+	// Written is the number of rows written to the output.
+	Written int
+	// Skipped is the number of malformed rows left out of the output.
+	Skipped int
+	// Invalid is the number of rows left out for failing the Schema.
+	Invalid int
+	// Filtered is the number of rows left out by Where or Sample.
+	Filtered int
+	// Duplicates is the number of rows left out by DedupOn.
+	Duplicates int
+	// Errors is the number of parsed rows that failed to be written.
+	Errors int
+}
+
+// Add adds the counts of other to s.
+func (s *Stats) Add(other Stats) {
+	s.Read += other.Read
+	s.Written += other.Written
+	s.Skipped += other.Skipped
+	s.Invalid += other.Invalid
+	s.Filtered += other.Filtered
+	s.Duplicates += other.Duplicates
+	s.Errors += other.Errors
+}
+
+// Source is one named CSV input to ConvertSources.
+type Source struct {
+	// Name identifies the input in warnings and errors, and is the value
+	// stored under Options.SourceKey.
+	Name string
+	// Open returns the CSV stream. It is called when the source's turn
+	// comes, and the stream is closed once it has been read.
+	Open func() (io.ReadCloser, error)
+}
+
+// task is one parsed row. Line is its data row number within its source;
+// Seq numbers rows across all sources and orders the output. Fields lists the
+// row's top-level keys in header order.
+type task struct {
+	Row    map[string]interface{}
+	Fields []string
+	Source string
+	Line   int
+	Seq    int
+
+	// Data holds the row as encoded by the worker, or Record its CSV
+	// values in Fields order, ready for the writer. Err is set instead
+	// when encoding failed.
+	Data   []byte
+	Record []string
+	Err    error
+}
+
+// Convert reads CSV from r and writes the rows to w as JSON. The first
+// record is used as the header and its names, transformed per opts.KeyCase,
+// become the keys of each object.
+//
+// Cancelling ctx stops the reader and workers; the rows already written are
+// closed off as valid output and ctx.Err() is returned.
+func Convert(ctx context.Context, r io.Reader, w io.Writer, opts Options) (Stats, error) {
+	source := Source{Open: func() (io.ReadCloser, error) { return io.NopCloser(r), nil }}
+	return ConvertSources(ctx, []Source{source}, w, opts)
+}
+
+// ConvertSources converts each source in turn into a single output on w,
+// sharing one worker pool. Every source has its own header row.
+func ConvertSources(ctx context.Context, sources []Source, w io.Writer, opts Options) (Stats, error) {
+	var stats Stats
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+
+	workerCount := opts.Workers
+	if workerCount == 0 {
+		workerCount = runtime.NumCPU()
+	}
+	if workerCount < 1 {
+		return stats, fmt.Errorf("workers must be at least 1, got %d", workerCount)
+	}
+	if opts.QueueSize < 0 {
+		return stats, fmt.Errorf("queue size must not be negative, got %d", opts.QueueSize)
+	}
+	if opts.Rate < 0 {
+		return stats, fmt.Errorf("rate must not be negative, got %g", opts.Rate)
+	}
+	if opts.Format == "" {
+		opts.Format = FormatJSONL
+	}
+	switch opts.Format {
+	case FormatJSONL, FormatJSONArray, FormatCSV, FormatYAML:
+	default:
+		return stats, fmt.Errorf("unknown format %q", opts.Format)
+	}
+	if opts.BatchSize < 0 {
+		return stats, fmt.Errorf("batch size must not be negative, got %d", opts.BatchSize)
+	}
+	if opts.Indent != "" && (opts.BatchSize > 0 || opts.ActionLine != "") {
+		return stats, errors.New("indent can't be combined with batching or an action line, which need one row per line")
+	}
+	if opts.BatchSize > 0 && opts.Format != FormatJSONL {
+		return stats, fmt.Errorf("batch size requires format %q, got %q", FormatJSONL, opts.Format)
+	}
+	if opts.ActionLine != "" {
+		if opts.Format != FormatJSONL || opts.BatchSize > 0 {
+			return stats, fmt.Errorf("action line requires format %q without batching", FormatJSONL)
+		}
+		if strings.ContainsAny(opts.ActionLine, "\r\n") {
+			return stats, errors.New("action line must be a single line")
+		}
+	}
+	if opts.Sink != nil && (opts.BatchSize > 0 || opts.ActionLine != "" || opts.SplitRows > 0) {
+		return stats, errors.New("a sink can't be combined with batching, an action line or split rows")
+	}
+	if opts.Trailer != nil && (opts.Format == FormatCSV || opts.BatchSize > 0 || opts.ActionLine != "" || opts.SplitRows > 0 || opts.Sink != nil) {
+		return stats, errors.New("a trailer can't be combined with format csv, batching, an action line, split rows or a sink")
+	}
+	if opts.PartitionBy != "" {
+		if opts.OpenPartition == nil {
+			return stats, errors.New("partitioning requires OpenPartition")
+		}
+		if opts.SplitRows > 0 || opts.Sink != nil || opts.Trailer != nil {
+			return stats, errors.New("partitioning can't be combined with split rows, a sink or a trailer")
+		}
+	}
+	if opts.SplitRows < 0 {
+		return stats, fmt.Errorf("split rows must not be negative, got %d", opts.SplitRows)
+	}
+	if opts.SplitRows > 0 && opts.NextPart == nil {
+		return stats, errors.New("split rows requires NextPart")
+	}
+	opts, decoding, err := prepareInput(opts)
+	if err != nil {
+		return stats, err
+	}
+
+	writer := newRowWriter(w, opts)
+	if err := writer.begin(); err != nil {
+		return stats, err
+	}
+
+	// A fatal read or write error cancels the rest of the pipeline
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queueSize := opts.QueueSize
+	if queueSize == 0 {
+		queueSize = 4 * workerCount
+	}
+	tasks := make(chan task, queueSize)
+	results := make(chan task, queueSize)
+
+	var wg sync.WaitGroup
+	var readErr, writeErr error
+
+	// The limiter is shared, so the rate holds however many workers run
+	var limiter *rate.Limiter
+	if opts.Rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(opts.Rate), int(math.Max(1, opts.Rate)))
+	}
+
+	// Start the worker pool, closing results once every worker is done
+	var workers sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		workers.Add(1)
+		go worker(ctx, tasks, results, &workers, writer, limiter, opts.HashKey)
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	state := newReadState(opts)
+
+	// Start the readers, which take the CSV inputs in turn: a single one
+	// reads them one after another. Every reader sends to tasks, so it is
+	// closed only once they are all done.
+	readers := 1
+	if opts.ConcurrentSources {
+		readers = workerCount
+		if len(sources) < readers {
+			readers = len(sources)
+		}
+	}
+	pending := make(chan Source, len(sources))
+	for _, source := range sources {
+		pending <- source
+	}
+	close(pending)
+	var readMu sync.Mutex
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := range pending {
+				read, err := readSource(ctx, source, decoding, opts, tasks, state)
+				// The first error is the cause; readers that fail after
+				// it was set only report the cancellation
+				readMu.Lock()
+				stats.Add(read)
+				if err != nil && readErr == nil {
+					readErr = err
+				}
+				readMu.Unlock()
+				if err != nil {
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(tasks)
+	}()
+
+	// This goroutine is the only writer: it owns the output and drains
+	// results until the workers are done. The first failed row aborts the
+	// conversion, since the output can no longer be complete; whatever is
+	// still queued is drained and dropped so no worker blocks.
+	for t := range results {
+		if writeErr != nil {
+			continue
+		}
+		err := t.Err
+		if err == nil {
+			err = writer.write(t)
+		}
+		if err != nil {
+			// The readers may still be adding to stats
+			readMu.Lock()
+			stats.Errors++
+			readMu.Unlock()
+			writeErr = &RowError{Source: t.Source, Line: t.Line, Err: fmt.Errorf("writing row: %w", err)}
+			cancel()
+		}
+	}
+
+	// Wait for the readers to finish
+	wg.Wait()
+
+	// The trailer vouches for a complete output, so it is left out of a
+	// failed or cancelled one
+	var trailer func() map[string]interface{}
+	if opts.Trailer != nil && writeErr == nil && readErr == nil && parent.Err() == nil {
+		trailer = func() map[string]interface{} {
+			stats.Written = writer.written
+			return opts.Trailer(stats)
+		}
+	}
+
+	// Close any framing even when cancelled so the rows written so far
+	// remain valid output. A write error explains the cancellation the
+	// reader reports, so it takes precedence.
+	err = writer.end(trailer)
+	stats.Written = writer.written
+	if writeErr != nil {
+		return stats, writeErr
+	}
+	if err != nil {
+		return stats, err
+	}
+	if readErr != nil {
+		return stats, readErr
+	}
+	return stats, parent.Err()
+}
+
+// lookupEncoding resolves an IANA character set name. It returns nil for
+// UTF-8, which needs no decoding.
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("unsupported encoding %q", name)
+	}
+	if enc == xunicode.UTF8 {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+// inferValue converts a cell to an int, float or bool when the text
+// round-trips exactly, and otherwise returns it unchanged as a string. The
+// round-trip check keeps values like "007" or "1.50" as strings so IDs and
+// ZIP codes are not silently altered.
+func inferValue(value string) interface{} {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(i, 10) == value {
+		return i
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) &&
+		strconv.FormatFloat(f, 'f', -1, 64) == value {
+		return f
+	}
+	if b, err := strconv.ParseBool(value); err == nil && strconv.FormatBool(b) == value {
+		return b
+	}
+	return value
+}
+
+// prepareInput checks the options that govern reading and fills in their
+// defaults, returning the decoding of opts.Encoding.
+func prepareInput(opts Options) (Options, encoding.Encoding, error) {
+	if opts.Delimiter == 0 {
+		opts.Delimiter = ','
+	}
+	if !validWidths(opts.Widths) {
+		return opts, nil, fmt.Errorf("widths must be positive, got %v", opts.Widths)
+	}
+	if opts.DetectDelimiter && (len(opts.Widths) > 0 || opts.SplitRegex != nil) {
+		return opts, nil, errors.New("delimiter detection can't be combined with widths or a split pattern")
+	}
+	if opts.Comment != 0 && opts.Comment == opts.Delimiter && !opts.DetectDelimiter {
+		return opts, nil, fmt.Errorf("comment character %q must differ from the delimiter", opts.Comment)
+	}
+	if opts.KeyCase == "" {
+		opts.KeyCase = KeyCaseLower
+	}
+	switch opts.KeyCase {
+	case KeyCaseLower, KeyCaseOriginal, KeyCaseUpper, KeyCaseSnake:
+	default:
+		return opts, nil, fmt.Errorf("unknown key case %q", opts.KeyCase)
+	}
+	switch opts.ValueCase {
+	case "", KeyCaseLower, KeyCaseUpper:
+	default:
+		return opts, nil, fmt.Errorf("unknown value case %q", opts.ValueCase)
+	}
+	if opts.Sample < 0 || opts.Sample > 1 {
+		return opts, nil, fmt.Errorf("sample must be between 0 and 1, got %g", opts.Sample)
+	}
+	if opts.MaxFieldSize < 0 {
+		return opts, nil, fmt.Errorf("max field size must not be negative, got %d", opts.MaxFieldSize)
+	}
+	if opts.SkipRows < 0 {
+		return opts, nil, fmt.Errorf("skip rows must not be negative, got %d", opts.SkipRows)
+	}
+	if opts.Limit < 0 {
+		return opts, nil, fmt.Errorf("limit must not be negative, got %d", opts.Limit)
+	}
+	if opts.StrictColumns && len(opts.RequireColumns) == 0 {
+		return opts, nil, errors.New("strict columns requires the columns to be listed in RequireColumns")
+	}
+	decoding, err := lookupEncoding(opts.Encoding)
+	return opts, decoding, err
+}
+
+// readSource opens source, decodes it to UTF-8 when decoding is set, and
+// parses it with readAndParseCSV.
+func readSource(ctx context.Context, source Source, decoding encoding.Encoding, opts Options, tasks chan<- task, state *readState) (Stats, error) {
+	input, err := source.Open()
+	if err != nil {
+		return Stats{}, err
+	}
+	defer input.Close()
+
+	var r io.Reader = input
+	if decoding != nil {
+		r = transform.NewReader(input, decoding.NewDecoder())
+	}
+	stats, err := readAndParseCSV(ctx, source.Name, r, opts, tasks, state)
+	// A RowError already names its source
+	var rowErr *RowError
+	if err != nil && source.Name != "" && !errors.Is(err, ctx.Err()) && !errors.As(err, &rowErr) {
+		err = fmt.Errorf("%s: %w", source.Name, err)
+	}
+	return stats, err
+}
+
+// readAndParseCSV parses CSV from input and sends each row to tasks until the
+// input is exhausted, a fatal error occurs or ctx is cancelled. state is
+// shared across sources. It returns the counts of rows sent, skipped as
+// malformed, rejected by the schema, filtered out and dropped as duplicates.
+//
+// A skipped or rejected row is still sent as a task with a nil Row so that an ordered
+// writer can move past its sequence number.
+func readAndParseCSV(ctx context.Context, name string, input io.Reader, opts Options, tasks chan<- task, state *readState) (Stats, error) {
+	var stats Stats
+
+	var guard *recordGuard
+	buffered := skipBOM(input)
+	if opts.DetectDelimiter {
+		opts.Delimiter = sniffDelimiter(buffered, opts)
+		if opts.DelimiterDetected != nil {
+			opts.DelimiterDetected(name, opts.Delimiter)
+		}
+	}
+	input = &lineEndingReader{input: buffered}
+	if opts.MaxFieldSize > 0 {
+		// Until the header is read, allow a record of a single column
+		guard = &recordGuard{input: input}
+		guard.reset(1, opts.MaxFieldSize)
+		input = guard
+	}
+	reader := newRecordReader(input, opts)
+	for n := 0; n < opts.SkipRows; n++ {
+		if _, err := reader.Read(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return stats, fmt.Errorf("cannot skip %d rows: input has only %d", opts.SkipRows, n)
+			}
+			return stats, fmt.Errorf("skipping leading rows: %w", err)
+		}
+	}
+
+	// Without a header row the first record is data, so it is held back
+	// and fed into the loop below before reading any further
+	var headers, first []string
+	if opts.NoHeader {
+		record, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				warnEmpty(name, opts)
+				return stats, nil
+			}
+			return stats, fmt.Errorf("reading CSV record: %w", err)
+		}
+		first = record
+		headers = syntheticHeaders(len(record))
+	} else {
+		record, err := reader.Read()
+		if err != nil {
+			// An empty input converts to empty output, like a header-only one
+			if errors.Is(err, io.EOF) {
+				warnEmpty(name, opts)
+				return stats, nil
+			}
+			return stats, fmt.Errorf("reading CSV headers: %w", err)
+		}
+		headers = record
+	}
+	switch {
+	case len(opts.Headers) > 0 && opts.NoHeader:
+		// The first record is data, so a field count that differs from the
+		// names is reported like any other row's
+		headers = opts.Headers
+	case len(opts.Headers) > 0:
+		if len(opts.Headers) != len(headers) {
+			return stats, fmt.Errorf("got %d header names for %d columns", len(opts.Headers), len(headers))
+		}
+		headers = opts.Headers
+	}
+
+	// Transform the header names once rather than per row
+	keys := make([]string, len(headers))
+	for i, name := range headers {
+		if opts.Trim {
+			name = strings.TrimSpace(name)
+		}
+		keys[i] = applyKeyCase(name, opts.KeyCase)
+	}
+	if err := dedupeKeys(name, keys, opts); err != nil {
+		return stats, err
+	}
+	// Select and the options like it name columns before Rename applies,
+	// the others after
+	named := newColumnIndex(keys, opts.KeyCase)
+	if err := checkColumns(named, opts); err != nil {
+		return stats, err
+	}
+	columns, err := selectColumns(named, opts)
+	if err != nil {
+		return stats, err
+	}
+	asString, err := stringColumns(named, opts)
+	if err != nil {
+		return stats, err
+	}
+	if err := renameKeys(name, keys, named, opts); err != nil {
+		return stats, err
+	}
+	renamed := newColumnIndex(keys, opts.KeyCase)
+	layout := rowLayout{keys: keys, columns: columns, asString: asString, nulls: nullSet(opts)}
+	if opts.NestSeparator != "" {
+		layout.paths, err = nestPaths(keys, columns, opts.NestSeparator)
+		if err != nil {
+			return stats, err
+		}
+	}
+	layout.fields = outputFields(layout, opts)
+	if opts.PartitionBy != "" {
+		found := false
+		for _, field := range layout.fields {
+			found = found || field == opts.PartitionBy
+		}
+		if !found {
+			return stats, fmt.Errorf("partition column %q not found; available columns: %s", opts.PartitionBy, strings.Join(layout.fields, ", "))
+		}
+	}
+	layout.checks, err = schemaChecks(opts.Schema, renamed)
+	if err != nil {
+		return stats, err
+	}
+	layout.dates, err = dateColumns(opts.DateColumns, renamed)
+	if err != nil {
+		return stats, err
+	}
+	if opts.ValueCase != "" {
+		// RFC 3339 dates need their upper-case T and Z
+		layout.keepCase = make([]bool, len(keys))
+		for _, date := range layout.dates {
+			layout.keepCase[date.index] = true
+		}
+	}
+	layout.arrays, err = arraySeparators(opts.ArrayColumns, renamed)
+	if err != nil {
+		return stats, err
+	}
+	layout.transforms, err = transformColumns(opts.Transforms, renamed)
+	if err != nil {
+		return stats, err
+	}
+	layout.where, err = whereChecks(opts.Where, renamed)
+	if err != nil {
+		return stats, err
+	}
+	layout.dedup, err = dedupColumns(opts.DedupOn, renamed)
+	if err != nil {
+		return stats, err
+	}
+	if opts.Header != nil {
+		opts.Header(name, layout.fields)
+	}
+
+	lineNumber := 0
+	for {
+		if opts.Limit > 0 && stats.Read >= opts.Limit {
+			return stats, nil
+		}
+
+		record := first
+		first = nil
+		var err error
+		if record == nil {
+			if guard != nil {
+				guard.reset(len(keys), opts.MaxFieldSize)
+			}
+			record, err = reader.Read()
+		}
+		lineNumber++
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return stats, nil
+			}
+			if errors.Is(err, errRecordTooLarge) {
+				return stats, &RowError{Source: name, Line: lineNumber, Err: fmt.Errorf("record exceeds %d bytes of input", guard.limit)}
+			}
+			// Malformed records can be stepped over; anything else, such as
+			// an I/O error, ends the read
+			var parseErr *csv.ParseError
+			if opts.Strict || !errors.As(err, &parseErr) {
+				return stats, &RowError{Source: name, Line: lineNumber, Err: fmt.Errorf("reading CSV record: %w", err)}
+			}
+			if opts.Warn != nil {
+				opts.Warn(name, lineNumber, fmt.Sprintf("skipping malformed row: %v", err))
+			}
+			if opts.Reject != nil {
+				opts.Reject(name, lineNumber, record, err.Error())
+			}
+			stats.Skipped++
+			record = nil
+		}
+
+		// Rows filtered out aren't validated, so they raise no warnings
+		if record != nil && opts.MaxFieldSize > 0 {
+			if err := oversizedField(record, keys, opts.MaxFieldSize); err != nil {
+				if opts.Strict {
+					return stats, &RowError{Source: name, Line: lineNumber, Err: err}
+				}
+				if opts.Warn != nil {
+					opts.Warn(name, lineNumber, fmt.Sprintf("skipping malformed row: %v", err))
+				}
+				if opts.Reject != nil {
+					opts.Reject(name, lineNumber, record, err.Error())
+				}
+				stats.Skipped++
+				record = nil
+			}
+		}
+
+		if record != nil && layout.where != nil && !matches(record, layout.where, opts) {
+			stats.Filtered++
+			record = nil
+		}
+
+		if record != nil && state.sampledOut(opts) {
+			stats.Filtered++
+			record = nil
+		}
+
+		if record != nil && len(record) != len(keys) {
+			if opts.Strict {
+				return stats, &RowError{Source: name, Line: lineNumber, Err: fmt.Errorf("expected %d fields, got %d", len(keys), len(record))}
+			}
+			if opts.Warn != nil {
+				opts.Warn(name, lineNumber, fmt.Sprintf("expected %d fields, got %d", len(keys), len(record)))
+			}
+		}
+
+		if record != nil && layout.checks != nil {
+			if err := validateRecord(record, layout, opts); err != nil {
+				if opts.Strict {
+					return stats, &RowError{Source: name, Line: lineNumber, Err: err}
+				}
+				if opts.Warn != nil {
+					opts.Warn(name, lineNumber, fmt.Sprintf("skipping invalid row: %v", err))
+				}
+				if opts.Reject != nil {
+					opts.Reject(name, lineNumber, record, err.Error())
+				}
+				stats.Invalid++
+				record = nil
+			}
+		}
+
+		if record != nil && layout.dates != nil {
+			normalized, err := normalizeDates(record, layout, opts)
+			if err != nil {
+				switch {
+				case opts.Strict:
+					return stats, &RowError{Source: name, Line: lineNumber, Err: err}
+				case opts.SkipInvalidDates:
+					if opts.Warn != nil {
+						opts.Warn(name, lineNumber, fmt.Sprintf("skipping row with invalid date: %v", err))
+					}
+					if opts.Reject != nil {
+						opts.Reject(name, lineNumber, record, err.Error())
+					}
+					stats.Invalid++
+					record = nil
+				default:
+					if opts.Warn != nil {
+						opts.Warn(name, lineNumber, fmt.Sprintf("%v; value kept as is", err))
+					}
+				}
+			}
+			if record != nil {
+				record = normalized
+			}
+		}
+
+		if record != nil && layout.transforms != nil {
+			record = applyTransforms(record, layout.transforms)
+		}
+
+		if record != nil && layout.dedup != nil && state.seenBefore(record, layout.dedup, opts) {
+			stats.Duplicates++
+			record = nil
+		}
+
+		var row map[string]interface{}
+		if record != nil {
+			row = buildRow(record, layout, opts)
+			if opts.SourceKey != "" {
+				row[opts.SourceKey] = name
+			}
+			if opts.LineKey != "" {
+				row[opts.LineKey] = lineNumber
+			}
+			for _, field := range opts.AddFields {
+				switch field.Value {
+				case FieldLine:
+					row[field.Key] = lineNumber
+				case FieldSource:
+					row[field.Key] = name
+				default:
+					row[field.Key] = field.Value
+				}
+			}
+		}
+
+		// Send the parsed row to the tasks channel, giving up if cancelled
+		// so a stalled send can't block shutdown
+		select {
+		case tasks <- task{Row: row, Fields: layout.fields, Source: name, Line: lineNumber, Seq: state.nextSeq()}:
+		case <-ctx.Done():
+			return stats, ctx.Err()
+		}
+		if row == nil {
+			continue
+		}
+		stats.Read++
+
+		if opts.Progress != nil {
+			opts.Progress()
+		}
+	}
+}
+
+// columnIndex finds the columns named by options among a source's keys. A
+// name matches the key equal to it, or else the key equal to it after the
+// KeyCase transform, so that "id" finds "ID" with KeyCaseUpper while a key
+// given by Rename is found as written.
+type columnIndex struct {
+	keys    []string
+	index   map[string]int
+	keyCase string
+}
+
+// newColumnIndex indexes keys as they are now; the index doesn't follow
+// later changes to the slice.
+func newColumnIndex(keys []string, keyCase string) columnIndex {
+	index := make(map[string]int, len(keys))
+	for i, key := range keys {
+		index[key] = i
+	}
+	return columnIndex{keys: append([]string(nil), keys...), index: index, keyCase: keyCase}
+}
+
+// find returns the index of the column called name.
+func (c columnIndex) find(name string) (int, bool) {
+	if i, ok := c.index[name]; ok {
+		return i, true
+	}
+	i, ok := c.index[applyKeyCase(name, c.keyCase)]
+	return i, ok
+}
+
+// lookup is find for a column an option requires: a missing one is an error
+// naming the option's kind of column and listing the available ones.
+func (c columnIndex) lookup(kind, name string) (int, error) {
+	i, ok := c.find(name)
+	if !ok {
+		return 0, fmt.Errorf("%s column %q not found; available columns: %s", kind, name, c.available())
+	}
+	return i, nil
+}
+
+// available lists the keys for an error message.
+func (c columnIndex) available() string {
+	return strings.Join(c.keys, ", ")
+}
+
+// selectColumns returns the indexes of the columns to keep in each row, in
+// header order. Select narrows the columns first, then Exclude removes from
+// what is left.
+func selectColumns(columns columnIndex, opts Options) ([]int, error) {
+	keys := columns.keys
+	keep := make([]bool, len(keys))
+	for i := range keep {
+		keep[i] = len(opts.Select) == 0 && len(opts.Positions) == 0
+	}
+	for _, n := range opts.Positions {
+		if n < 1 || n > len(keys) {
+			return nil, fmt.Errorf("column position %d out of range; the header has %d columns", n, len(keys))
+		}
+		keep[n-1] = true
+	}
+	for _, name := range opts.Select {
+		i, err := columns.lookup("selected", name)
+		if err != nil {
+			return nil, err
+		}
+		keep[i] = true
+	}
+	for _, name := range opts.Exclude {
+		i, err := columns.lookup("excluded", name)
+		if err != nil {
+			return nil, err
+		}
+		keep[i] = false
+	}
+
+	kept := make([]int, 0, len(keys))
+	for i := range keys {
+		if keep[i] {
+			kept = append(kept, i)
+		}
+	}
+	return kept, nil
+}
+
+// warnEmpty reports an input with no records at all.
+func warnEmpty(source string, opts Options) {
+	if opts.Warn != nil {
+		opts.Warn(source, 0, "input is empty; no rows to convert")
+	}
+}
+
+// dedupeKeys makes repeated keys unique in place by suffixing the second and
+// later occurrences with _2, _3 and so on, so that no column overwrites
+// another in the row. Each repeat is reported through Warn, or is an error
+// when Strict.
+func dedupeKeys(source string, keys []string, opts Options) error {
+	taken := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		taken[key] = true
+	}
+	count := make(map[string]int, len(keys))
+	for i, key := range keys {
+		count[key]++
+		if count[key] == 1 {
+			continue
+		}
+		if opts.Strict {
+			return fmt.Errorf("duplicate column %q", key)
+		}
+		unique := key
+		for n := count[key]; taken[unique]; n++ {
+			unique = fmt.Sprintf("%s_%d", key, n)
+		}
+		taken[unique] = true
+		keys[i] = unique
+		if opts.Warn != nil {
+			opts.Warn(source, 0, fmt.Sprintf("duplicate column %q renamed to %q", key, unique))
+		}
+	}
+	return nil
+}
+
+// checkColumns checks a source's keys against opts.RequireColumns, listing
+// every missing column, and with opts.StrictColumns every unexpected one.
+func checkColumns(columns columnIndex, opts Options) error {
+	if len(opts.RequireColumns) == 0 {
+		return nil
+	}
+	required := make(map[int]bool, len(opts.RequireColumns))
+	var missing []string
+	for _, name := range opts.RequireColumns {
+		i, ok := columns.find(name)
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		required[i] = true
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required columns not found: %s; available columns: %s", strings.Join(missing, ", "), columns.available())
+	}
+	if !opts.StrictColumns {
+		return nil
+	}
+	var unexpected []string
+	for i, key := range columns.keys {
+		if !required[i] {
+			unexpected = append(unexpected, key)
+		}
+	}
+	if len(unexpected) > 0 {
+		return fmt.Errorf("unexpected columns: %s; expected only %s", strings.Join(unexpected, ", "), strings.Join(opts.RequireColumns, ", "))
+	}
+	return nil
+}
+
+// stringColumns marks the columns named in opts.StringColumns, which are
+// looked up like Select. It returns nil when there are none.
+func stringColumns(columns columnIndex, opts Options) ([]bool, error) {
+	if len(opts.StringColumns) == 0 {
+		return nil, nil
+	}
+	asString := make([]bool, len(columns.keys))
+	for _, name := range opts.StringColumns {
+		i, err := columns.lookup("string", name)
+		if err != nil {
+			return nil, err
+		}
+		asString[i] = true
+	}
+	return asString, nil
+}
+
+// renameKeys applies opts.Rename to keys in place, finding the columns to
+// rename in columns, the index of keys before any are renamed.
+func renameKeys(source string, keys []string, columns columnIndex, opts Options) error {
+	if len(opts.Rename) == 0 {
+		return nil
+	}
+	for from, to := range opts.Rename {
+		i, ok := columns.find(from)
+		if !ok {
+			msg := fmt.Sprintf("renamed column %q not found; available columns: %s", from, columns.available())
+			if opts.Strict {
+				return errors.New(msg)
+			}
+			if opts.Warn != nil {
+				opts.Warn(source, 0, msg)
+			}
+			continue
+		}
+		keys[i] = to
+	}
+	return nil
+}
+
+// rowLayout describes how a source's records map onto output rows. It is
+// worked out once from the header.
+type rowLayout struct {
+	keys []string
+	// columns holds the indexes of the keys kept in each row.
+	columns []int
+	// paths holds the nested key path of each key when nesting, else nil.
+	paths [][]string
+	// asString marks the columns exempt from type inference, or is nil.
+	asString []bool
+	// nulls holds the values written as null, lowercased when matching
+	// ignores case.
+	nulls map[string]bool
+	// fields lists the top-level keys of each row in header order.
+	fields []string
+	// checks holds the schema columns to validate, if any.
+	checks []columnCheck
+	// dates holds the columns to normalize as RFC 3339, if any.
+	dates []dateColumn
+	// arrays holds the separator of each array column by index, or is nil.
+	arrays []string
+	// where holds the conditions rows must pass, if any.
+	where []whereCheck
+	// dedup holds the indexes of the DedupOn columns, or is nil.
+	dedup []int
+	// transforms holds the Transforms to apply, if any.
+	transforms []columnTransform
+	// keepCase marks the columns exempt from ValueCase, or is nil.
+	keepCase []bool
+}
+
+// outputFields lists the top-level keys a row built with layout can have, in
+// header order, followed by the source and overflow keys when set.
+func outputFields(layout rowLayout, opts Options) []string {
+	fields := make([]string, 0, len(layout.columns)+2)
+	seen := make(map[string]bool, len(layout.columns))
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			fields = append(fields, key)
+		}
+	}
+	for _, i := range layout.columns {
+		if layout.paths != nil {
+			add(layout.paths[i][0])
+		} else {
+			add(layout.keys[i])
+		}
+	}
+	if opts.SourceKey != "" {
+		add(opts.SourceKey)
+	}
+	if opts.LineKey != "" {
+		add(opts.LineKey)
+	}
+	for _, field := range opts.AddFields {
+		add(field.Key)
+	}
+	if opts.OverflowKey != "" {
+		add(opts.OverflowKey)
+	}
+	if opts.HashKey != "" {
+		add(opts.HashKey)
+	}
+	return fields
+}
+
+func nullSet(opts Options) map[string]bool {
+	if len(opts.NullValues) == 0 {
+		return nil
+	}
+	nulls := make(map[string]bool, len(opts.NullValues))
+	for _, value := range opts.NullValues {
+		if opts.NullCaseInsensitive {
+			value = strings.ToLower(value)
+		}
+		nulls[value] = true
+	}
+	return nulls
+}
+
+// isNull reports whether cell is one of the configured null tokens.
+func (l rowLayout) isNull(cell string, caseInsensitive bool) bool {
+	if l.nulls == nil {
+		return false
+	}
+	if caseInsensitive {
+		cell = strings.ToLower(cell)
+	}
+	return l.nulls[cell]
+}
+
+// nestPaths splits the kept keys on sep. A key that is both a value and a
+// parent of other keys, like "a" alongside "a.b", cannot be represented and is
+// an error.
+func nestPaths(keys []string, columns []int, sep string) ([][]string, error) {
+	paths := make([][]string, len(keys))
+	leaves := make(map[string]string)
+	branches := make(map[string]string)
+	for _, i := range columns {
+		path := strings.Split(keys[i], sep)
+		paths[i] = path
+		for depth := 1; depth < len(path); depth++ {
+			prefix := strings.Join(path[:depth], sep)
+			if leaf, ok := leaves[prefix]; ok {
+				return nil, fmt.Errorf("cannot nest %q: %q is already a value", keys[i], leaf)
+			}
+			branches[prefix] = keys[i]
+		}
+		if branch, ok := branches[keys[i]]; ok {
+			return nil, fmt.Errorf("cannot nest %q: it is also the parent of %q", keys[i], branch)
+		}
+		leaves[keys[i]] = keys[i]
+	}
+	return paths, nil
+}
+
+// buildRow maps the chosen columns of a record onto their keys. Missing
+// trailing fields become null, empty ones are left out with opts.OmitEmpty,
+// and extra fields go under opts.OverflowKey when it is set.
+func buildRow(record []string, layout rowLayout, opts Options) map[string]interface{} {
+	row := make(map[string]interface{}, len(layout.columns))
+	for _, i := range layout.columns {
+		// Missing trailing fields become null
+		var value interface{}
+		if i < len(record) {
+			cell := record[i]
+			if opts.Trim {
+				cell = strings.TrimSpace(cell)
+			}
+			if cell == "" && opts.OmitEmpty {
+				continue
+			}
+			if layout.isNull(cell, opts.NullCaseInsensitive) {
+				value = nil
+			} else if layout.arrays != nil && layout.arrays[i] != "" {
+				value = splitArray(cell, layout.arrays[i], opts)
+			} else if opts.InferTypes && (layout.asString == nil || !layout.asString[i]) {
+				value = inferValue(cell)
+			} else {
+				value = cell
+			}
+			if layout.keepCase != nil && !layout.keepCase[i] {
+				value = applyValueCase(value, opts.ValueCase)
+			}
+		}
+
+		if layout.paths == nil {
+			row[layout.keys[i]] = value
+			continue
+		}
+		setNested(row, layout.paths[i], value)
+	}
+	if len(record) > len(layout.keys) && opts.OverflowKey != "" {
+		row[opts.OverflowKey] = record[len(layout.keys):]
+	}
+	return row
+}
+
+// setNested stores value at path inside row, creating intermediate objects.
+// nestPaths has already ruled out paths that run through a value.
+func setNested(row map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		child, ok := row[key].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			row[key] = child
+		}
+		row = child
+	}
+	row[path[len(path)-1]] = value
+}
+
+// applyValueCase changes the case of a string value, or of each item of an
+// array column, per ValueCase; other values are returned unchanged.
+func applyValueCase(value interface{}, valueCase string) interface{} {
+	change := strings.ToLower
+	if valueCase == KeyCaseUpper {
+		change = strings.ToUpper
+	}
+	switch v := value.(type) {
+	case string:
+		return change(v)
+	case []string:
+		for i := range v {
+			v[i] = change(v[i])
+		}
+	}
+	return value
+}
+
+// applyKeyCase transforms a header name according to one of the KeyCase
+// modes.
+func applyKeyCase(name, keyCase string) string {
+	switch keyCase {
+	case KeyCaseOriginal:
+		return name
+	case KeyCaseUpper:
+		return strings.ToUpper(name)
+	case KeyCaseSnake:
+		return toSnakeCase(name)
+	default:
+		return strings.ToLower(name)
+	}
+}
+
+// toSnakeCase lowercases name and separates its words with underscores.
+// Words are split on non-alphanumeric characters and at case changes, so
+// "UserID" becomes "user_id" and "HTTPServer" becomes "http_server".
+func toSnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	sep := false
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			sep = b.Len() > 0
+			continue
+		}
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				sep = b.Len() > 0
+			}
+		}
+		if sep {
+			b.WriteByte('_')
+			sep = false
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// skipBOM drops a leading UTF-8 byte order mark, as written by Excel, which
+// would otherwise end up in the first header name (or break parsing when that
+// name is quoted).
+func skipBOM(input io.Reader) *bufio.Reader {
+	br := bufio.NewReader(input)
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\uFEFF" {
+		br.Discard(3)
+	}
+	return br
+}
+
+// delimiterCandidates are the separators DetectDelimiter chooses from, in
+// order of preference when counts tie.
+var delimiterCandidates = []rune{',', '\t', ';', '|'}
+
+// sniffDelimiter picks the delimiter of the header line at the start of
+// input without consuming it, passing over the SkipRows records and any
+// comment lines first. Only what fits in input's buffer is looked at, so a
+// longer header is judged by its beginning.
+func sniffDelimiter(input *bufio.Reader, opts Options) rune {
+	data, _ := input.Peek(input.Size())
+	lines := strings.FieldsFunc(string(data), func(r rune) bool { return r == '\n' || r == '\r' })
+	skip := opts.SkipRows
+	var header string
+	for _, line := range lines {
+		if opts.Comment != 0 && strings.HasPrefix(line, string(opts.Comment)) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		header = line
+		break
+	}
+
+	counts := make(map[rune]int)
+	quoted := false
+	for _, r := range header {
+		if r == '"' {
+			quoted = !quoted
+		} else if !quoted {
+			counts[r]++
+		}
+	}
+	best := delimiterCandidates[0]
+	for _, candidate := range delimiterCandidates[1:] {
+		if candidate != opts.Comment && counts[candidate] > counts[best] {
+			best = candidate
+		}
+	}
+	return best
+}
+
+// lineEndingReader rewrites CRLF and lone CR line endings, as written by
+// Windows and classic Mac OS tools, as LF. csv.Reader already drops the CR of
+// a CRLF, but takes a lone CR for part of a field, which would read a whole
+// CR-only file as a single record. A lone CR inside a quoted field also
+// becomes LF.
+type lineEndingReader struct {
+	input io.Reader
+	// afterCR is set when the last byte read was a CR, so that an LF
+	// starting the next read is recognized as the rest of a CRLF.
+	afterCR bool
+}
+
+func (r *lineEndingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.input.Read(p)
+		out := 0
+		for _, b := range p[:n] {
+			switch {
+			case b == '\r':
+				p[out] = '\n'
+				out++
+				r.afterCR = true
+				continue
+			case b == '\n' && r.afterCR:
+				// Already written when the CR was seen
+			default:
+				p[out] = b
+				out++
+			}
+			r.afterCR = false
+		}
+		// A read holding only the LF of a split CRLF yields no bytes; read
+		// again rather than return 0 bytes without an error
+		if out > 0 || err != nil || n == 0 {
+			return out, err
+		}
+	}
+}
+
+// syntheticHeaders returns the keys col1, col2, ... used for input without a
+// header row.
+func syntheticHeaders(n int) []string {
+	headers := make([]string, n)
+	for i := range headers {
+		headers[i] = "col" + strconv.Itoa(i+1)
+	}
+	return headers
+}
+
+// addHash stores the hex SHA-256 digest of row's JSON encoding under key,
+// unless key or row is empty. encoding/json sorts map keys, nested ones
+// included, so the encoding of equal rows is always the same.
+func addHash(row map[string]interface{}, key string) error {
+	if key == "" || row == nil {
+		return nil
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	row[key] = hex.EncodeToString(sum[:])
+	return nil
+}
+
+// worker encodes rows from tasks and passes them on to results until the
+// channel closes or ctx is cancelled. A row that fails to encode is passed on
+// with Err set so the writer can report it. With a limiter, each row waits
+// for its turn first; skipped rows don't count against the rate. With a
+// hashKey, the row's hash is added just before encoding.
+func worker(ctx context.Context, tasks <-chan task, results chan<- task, wg *sync.WaitGroup, writer *rowWriter, limiter *rate.Limiter, hashKey string) {
+	defer wg.Done()
+
+	for {
+		var t task
+		select {
+		case <-ctx.Done():
+			return
+		case next, ok := <-tasks:
+			if !ok {
+				return
+			}
+			t = next
+		}
+
+		if limiter != nil && t.Row != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return
+			}
+		}
+		err := addHash(t.Row, hashKey)
+		if err == nil {
+			t, err = writer.encode(t)
+		}
+		if err != nil {
+			t.Err = err
+		}
+
+		select {
+		case results <- t:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
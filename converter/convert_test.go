@@ -0,0 +1,298 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// convertString converts input with opts and returns the output.
+func convertString(t *testing.T, input string, opts Options) (string, Stats) {
+	t.Helper()
+	var out bytes.Buffer
+	stats, err := Convert(context.Background(), strings.NewReader(input), &out, opts)
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	return out.String(), stats
+}
+
+// decodeLines decodes JSON Lines output into its rows.
+func decodeLines(t *testing.T, output string) []map[string]interface{} {
+	t.Helper()
+	var rows []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatalf("decoding %q: %v", line, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestQuotedNewlines(t *testing.T) {
+	input := "id,text\n1,\"line1\nline2\"\n2,plain\n3,\"a\r\nb\nc\"\n"
+	progress := 0
+	output, stats := convertString(t, input, Options{Workers: 1, Ordered: true, LineKey: "_line", Progress: func() { progress++ }})
+
+	rows := decodeLines(t, output)
+	want := []struct {
+		text string
+		line float64
+	}{
+		{"line1\nline2", 1},
+		{"plain", 2},
+		{"a\nb\nc", 3},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d:\n%s", len(rows), len(want), output)
+	}
+	for i, w := range want {
+		if rows[i]["text"] != w.text {
+			t.Errorf("row %d: text = %q, want %q", i+1, rows[i]["text"], w.text)
+		}
+		if rows[i]["_line"] != w.line {
+			t.Errorf("row %d: _line = %v, want %v", i+1, rows[i]["_line"], w.line)
+		}
+	}
+	if stats.Read != 3 || stats.Written != 3 {
+		t.Errorf("stats = %+v, want 3 rows read and written", stats)
+	}
+	if progress != 3 {
+		t.Errorf("Progress called %d times, want 3", progress)
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	want := []map[string]interface{}{
+		{"id": "1", "note": "a", "_line": float64(1)},
+		{"id": "2", "note": "b\nc", "_line": float64(2)},
+		{"id": "3", "note": "", "_line": float64(3)},
+	}
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"LF", "id,note\n1,a\n2,\"b\nc\"\n3,\n"},
+		{"CRLF", "id,note\r\n1,a\r\n2,\"b\r\nc\"\r\n3,\r\n"},
+		{"CR", "id,note\r1,a\r2,\"b\rc\"\r3,\r"},
+		{"mixed", "id,note\r\n1,a\r2,\"b\nc\"\r\n3,\n"},
+		{"no final line ending", "id,note\r\n1,a\r\n2,\"b\r\nc\"\r\n3,"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, reads := range []struct {
+				name string
+				wrap func(io.Reader) io.Reader
+			}{
+				{"whole", func(r io.Reader) io.Reader { return r }},
+				// A CRLF split across reads must still count as one line
+				// ending
+				{"one byte at a time", iotest.OneByteReader},
+			} {
+				var out bytes.Buffer
+				input := reads.wrap(strings.NewReader(tt.input))
+				stats, err := Convert(context.Background(), input, &out, Options{Workers: 1, Ordered: true, LineKey: "_line"})
+				if err != nil {
+					t.Fatalf("%s: Convert: %v", reads.name, err)
+				}
+				rows := decodeLines(t, out.String())
+				if len(rows) != len(want) || stats.Read != len(want) {
+					t.Fatalf("%s: got %d rows (%d read), want %d:\n%s", reads.name, len(rows), stats.Read, len(want), out.String())
+				}
+				for i := range want {
+					for key, value := range want[i] {
+						if rows[i][key] != value {
+							t.Errorf("%s: row %d: %s = %q, want %q", reads.name, i+1, key, rows[i][key], value)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestColumnNamesFollowKeyCase(t *testing.T) {
+	// Every option naming columns finds them by the name as written in
+	// lower case, though the keys are upper case, and a renamed key by its
+	// new name
+	where, err := ParseCondition("id >= 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transform, err := ParseTransform("name:upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		Workers:        1,
+		Ordered:        true,
+		KeyCase:        KeyCaseUpper,
+		InferTypes:     true,
+		RequireColumns: []string{"id", "name", "tags", "day"},
+		Select:         []string{"id", "name", "tags", "day"},
+		StringColumns:  []string{"id"},
+		Rename:         map[string]string{"day": "Date"},
+		Where:          []Condition{where},
+		Transforms:     []Transform{transform},
+		ArrayColumns:   map[string]string{"tags": ";"},
+		DateColumns:    map[string]string{"Date": "2006-01-02"},
+		DedupOn:        []string{"name"},
+		Schema:         &Schema{Columns: map[string]ColumnSchema{"id": {Type: TypeInt, Required: true}}},
+	}
+	input := "id,name,tags,day,extra\n1,a,x;y,2024-01-01,-\n2,b,x,2024-01-02,-\n3,b,y,2024-01-03,-\n"
+	output, _ := convertString(t, input, opts)
+	want := `{"Date":"2024-01-02T00:00:00Z","ID":"2","NAME":"B","TAGS":["x"]}` + "\n"
+	if output != want {
+		t.Errorf("output = %s, want %s", output, want)
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	formats := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"jsonl", Options{Format: FormatJSONL}, ""},
+		{"json-array", Options{Format: FormatJSONArray}, "[]\n"},
+		{"json-array indented", Options{Format: FormatJSONArray, Indent: "  "}, "[]\n"},
+		{"csv", Options{Format: FormatCSV}, ""},
+		{"yaml", Options{Format: FormatYAML}, ""},
+		{"yaml sequence", Options{Format: FormatYAML, YAMLSequence: true}, "[]\n"},
+	}
+	inputs := []struct {
+		name     string
+		input    string
+		warnings int
+	}{
+		{"empty", "", 1},
+		{"header only", "id,name\n", 0},
+		{"header only without newline", "id,name", 0},
+	}
+	for _, format := range formats {
+		for _, input := range inputs {
+			t.Run(format.name+"/"+input.name, func(t *testing.T) {
+				opts := format.opts
+				var warnings []string
+				opts.Warn = func(source string, line int, msg string) { warnings = append(warnings, msg) }
+				output, stats := convertString(t, input.input, opts)
+				if output != format.want {
+					t.Errorf("output = %q, want %q", output, format.want)
+				}
+				if stats != (Stats{}) {
+					t.Errorf("stats = %+v, want all zero", stats)
+				}
+				if len(warnings) != input.warnings {
+					t.Errorf("warnings = %q, want %d", warnings, input.warnings)
+				}
+			})
+		}
+	}
+}
+
+// syntheticCSV returns a CSV of rows rows with a mix of text and numbers.
+func syntheticCSV(rows int) string {
+	var b strings.Builder
+	b.WriteString("id,name,email,city,score,active\n")
+	for i := 1; i <= rows; i++ {
+		fmt.Fprintf(&b, "%d,Name %d,user%d@example.com,City %d,%d.%d,%t\n", i, i, i, i%100, i%1000, i%10, i%2 == 0)
+	}
+	return b.String()
+}
+
+func BenchmarkConvert(b *testing.B) {
+	for _, size := range []struct {
+		name string
+		rows int
+	}{
+		{"small", 100},
+		{"medium", 10000},
+		{"large", 100000},
+	} {
+		input := syntheticCSV(size.rows)
+		for _, workers := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("%s/workers=%d", size.name, workers), func(b *testing.B) {
+				benchmarkConvert(b, input, size.rows, Options{Workers: workers, InferTypes: true})
+			})
+		}
+	}
+}
+
+// BenchmarkQueueSize compares queue sizes with four workers: 1, which
+// nearly serializes reading and encoding, 16, the default of four per
+// worker, and a large 1024.
+func BenchmarkQueueSize(b *testing.B) {
+	const rows = 20000
+	input := syntheticCSV(rows)
+	for _, size := range []int{1, 4, 16, 64, 1024} {
+		b.Run(fmt.Sprintf("queue=%d", size), func(b *testing.B) {
+			benchmarkConvert(b, input, rows, Options{Workers: 4, QueueSize: size, InferTypes: true})
+		})
+	}
+}
+
+// benchmarkConvert converts input, of rows rows, b.N times, reporting bytes
+// and rows per second.
+func benchmarkConvert(b *testing.B, input string, rows int, opts Options) {
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Convert(context.Background(), strings.NewReader(input), io.Discard, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(rows)*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestWriteErrorWhileReading(t *testing.T) {
+	// The writer counts the failed row while the readers, still going,
+	// add up the rows they read
+	var sources []Source
+	for i := 0; i < 8; i++ {
+		input := syntheticCSV(2)
+		sources = append(sources, Source{Name: fmt.Sprintf("in%d.csv", i), Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(input)), nil
+		}})
+	}
+	stats, err := ConvertSources(context.Background(), sources, failingWriter{}, Options{Workers: 4, ConcurrentSources: true})
+	var rowErr *RowError
+	if !errors.As(err, &rowErr) {
+		t.Fatalf("err = %v, want a RowError", err)
+	}
+	if stats.Errors != 1 {
+		t.Errorf("Errors = %d, want 1", stats.Errors)
+	}
+}
+
+func TestRowErrorNamesTheRow(t *testing.T) {
+	// The second row starts on the fourth line of the file; the parse error
+	// gives the file line, and the RowError the row
+	input := "id,text\n1,\"a\nb\"\n2,\"c\"d\"\n"
+	sources := []Source{{Name: "bad.csv", Open: func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(input)), nil
+	}}}
+	_, err := ConvertSources(context.Background(), sources, io.Discard, Options{Workers: 1, Strict: true})
+	if err == nil {
+		t.Fatal("Convert succeeded, want a parse error")
+	}
+	if msg := err.Error(); !strings.HasPrefix(msg, "bad.csv row 2: ") || !strings.Contains(msg, "line 4") {
+		t.Errorf("error = %q, want row 2 and the parse error's line 4", msg)
+	}
+}
@@ -0,0 +1,65 @@
+package converter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dateColumn is a column of Options.DateColumns resolved to its index in a
+// source's records.
+type dateColumn struct {
+	name   string
+	index  int
+	layout string
+}
+
+// dateColumns resolves the date columns against a source's columns. Unlike
+// an optional schema column, a missing date column is an error.
+func dateColumns(layouts map[string]string, columns columnIndex) ([]dateColumn, error) {
+	if len(layouts) == 0 {
+		return nil, nil
+	}
+	var dates []dateColumn
+	for name, layout := range layouts {
+		i, err := columns.lookup("date", name)
+		if err != nil {
+			return nil, err
+		}
+		dates = append(dates, dateColumn{name: name, index: i, layout: layout})
+	}
+	// Report invalid dates in column order whatever the map order
+	sort.Slice(dates, func(a, b int) bool { return dates[a].index < dates[b].index })
+	return dates, nil
+}
+
+// normalizeDates returns a copy of the record with its date cells rewritten
+// as RFC 3339. Empty and null cells are left alone, as is any cell that
+// doesn't match its layout; the first such cell is described in the returned
+// error.
+func normalizeDates(record []string, layout rowLayout, opts Options) ([]string, error) {
+	record = append([]string(nil), record...)
+	var firstErr error
+	for _, date := range layout.dates {
+		if date.index >= len(record) {
+			continue
+		}
+		cell := record[date.index]
+		if opts.Trim {
+			cell = strings.TrimSpace(cell)
+		}
+		if cell == "" || layout.isNull(cell, opts.NullCaseInsensitive) {
+			continue
+		}
+		t, err := time.Parse(date.layout, cell)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = &ColumnError{Column: date.name, Err: fmt.Errorf("%q is not a valid date for layout %q", cell, date.layout)}
+			}
+			continue
+		}
+		record[date.index] = t.Format(time.RFC3339)
+	}
+	return record, firstErr
+}
@@ -0,0 +1,43 @@
+package converter
+
+import "fmt"
+
+// RowError is a failure tied to one row of a source. ConvertSources returns
+// it, wrapped or not, for a row that aborts the conversion, so callers can
+// recover the file and row with errors.As.
+type RowError struct {
+	// Source is the name of the row's source, and may be empty.
+	Source string
+	// Line is the row's number: 1 for the first data row, not counting
+	// the header or skipped rows. It is not the row's line in the file,
+	// which differs once a quoted field spans lines, so the message calls
+	// it a row.
+	Line int
+	Err  error
+}
+
+func (e *RowError) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("row %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s row %d: %v", e.Source, e.Line, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// ColumnError is a failure tied to one column of a row, such as a value that
+// doesn't match the Schema. It is usually found inside a RowError.
+type ColumnError struct {
+	Column string
+	Err    error
+}
+
+func (e *ColumnError) Error() string {
+	return fmt.Sprintf("column %q: %v", e.Column, e.Err)
+}
+
+func (e *ColumnError) Unwrap() error {
+	return e.Err
+}
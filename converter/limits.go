@@ -0,0 +1,56 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// errRecordTooLarge ends a read whose record has outgrown its recordGuard.
+var errRecordTooLarge = errors.New("record too large")
+
+// guardSlack allows for the bytes of later records that buffered readers have
+// already read ahead of the current one.
+const guardSlack = 64 << 10
+
+// recordGuard bounds how much input a single record may take, so that a
+// pathological field fails fast instead of being read into memory whole;
+// csv.Reader itself has no such limit. The count restarts with each record.
+type recordGuard struct {
+	input io.Reader
+	limit int64
+	read  int64
+}
+
+// reset starts a new record of up to columns fields of at most maxField
+// bytes each, allowing for every character being a doubled quote.
+func (g *recordGuard) reset(columns, maxField int) {
+	g.read = 0
+	g.limit = int64(columns)*(2*int64(maxField)+3) + guardSlack
+}
+
+func (g *recordGuard) Read(p []byte) (int, error) {
+	n, err := g.input.Read(p)
+	g.read += int64(n)
+	if g.read > g.limit {
+		return n, errRecordTooLarge
+	}
+	return n, err
+}
+
+// oversizedField returns an error describing the first field of record
+// longer than max bytes, or nil. Fields beyond the header are named by their
+// position.
+func oversizedField(record, keys []string, max int) error {
+	for i, field := range record {
+		if len(field) > max {
+			column := "#" + strconv.Itoa(i+1)
+			if i < len(keys) {
+				column = keys[i]
+			}
+			return &ColumnError{Column: column, Err: fmt.Errorf("%d bytes, over the %d byte limit", len(field), max)}
+		}
+	}
+	return nil
+}
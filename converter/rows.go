@@ -0,0 +1,69 @@
+package converter
+
+import (
+	"context"
+	"io"
+)
+
+// Rows parses CSV from r and yields each row as it would be converted,
+// honoring every option that shapes rows, such as Select, InferTypes and
+// Where, but encoding and writing nothing; output options such as Format and
+// Workers are ignored. Rows are yielded in input order from a single
+// goroutine.
+//
+// The rows channel is closed once the input is exhausted, a fatal error
+// occurs or ctx is cancelled. The error channel then yields the error that
+// ended the read, if any, and is closed. Callers that stop receiving rows
+// early must cancel ctx so that the reader can exit.
+func Rows(ctx context.Context, r io.Reader, opts Options) (<-chan map[string]interface{}, <-chan error) {
+	rows := make(chan map[string]interface{})
+	errs := make(chan error, 1)
+
+	opts, decoding, err := prepareInput(opts)
+	if err != nil {
+		close(rows)
+		errs <- err
+		close(errs)
+		return rows, errs
+	}
+
+	// A row that can't be hashed stops the reader too
+	ctx, cancel := context.WithCancel(ctx)
+	tasks := make(chan task)
+	source := Source{Open: func() (io.ReadCloser, error) { return io.NopCloser(r), nil }}
+	var readErr error
+	go func() {
+		defer close(tasks)
+		_, readErr = readSource(ctx, source, decoding, opts, tasks, newReadState(opts))
+	}()
+	go func() {
+		defer cancel()
+		defer close(errs)
+		var rowErr error
+		for t := range tasks {
+			// Left out rows only keep an ordered writer's sequence going,
+			// and once stopped the rest are drained until the reader ends
+			if t.Row == nil || rowErr != nil || ctx.Err() != nil {
+				continue
+			}
+			if err := addHash(t.Row, opts.HashKey); err != nil {
+				rowErr = &RowError{Source: t.Source, Line: t.Line, Err: err}
+				cancel()
+				continue
+			}
+			select {
+			case rows <- t.Row:
+			case <-ctx.Done():
+			}
+		}
+		close(rows)
+		// readErr was set before tasks was closed
+		switch {
+		case rowErr != nil:
+			errs <- rowErr
+		case readErr != nil:
+			errs <- readErr
+		}
+	}()
+	return rows, errs
+}
@@ -0,0 +1,121 @@
+package converter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Column types accepted in a Schema.
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeBool   = "bool"
+)
+
+// Schema describes the columns a row must have. Column names are matched
+// against the output keys, after KeyCase and Rename are applied, either as
+// written or after the KeyCase transform, so "id" finds the key "ID" with
+// KeyCaseUpper.
+//
+// In JSON form:
+//
+//	{"columns": {"id": {"type": "int", "required": true}, "name": {"type": "string"}}}
+type Schema struct {
+	Columns map[string]ColumnSchema `json:"columns"`
+}
+
+// ColumnSchema constrains a single column.
+type ColumnSchema struct {
+	// Type is TypeString, TypeInt, TypeFloat or TypeBool. Empty means
+	// TypeString.
+	Type string `json:"type"`
+	// Required rejects rows where the cell is empty or a null value, and
+	// input whose header lacks the column.
+	Required bool `json:"required"`
+}
+
+// ParseSchema reads a Schema in JSON form and checks its column types.
+func ParseSchema(r io.Reader) (*Schema, error) {
+	var schema Schema
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&schema); err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	for name, column := range schema.Columns {
+		switch column.Type {
+		case "", TypeString, TypeInt, TypeFloat, TypeBool:
+		default:
+			return nil, fmt.Errorf("schema column %q: unknown type %q", name, column.Type)
+		}
+	}
+	return &schema, nil
+}
+
+// columnCheck is a schema column resolved to its index in a source's records.
+type columnCheck struct {
+	name   string
+	index  int
+	column ColumnSchema
+}
+
+// schemaChecks resolves the schema's columns against a source's columns. A
+// required column missing from the header is an error; an optional one is
+// simply not checked.
+func schemaChecks(schema *Schema, columns columnIndex) ([]columnCheck, error) {
+	if schema == nil {
+		return nil, nil
+	}
+	var checks []columnCheck
+	for name, column := range schema.Columns {
+		i, ok := columns.find(name)
+		if !ok {
+			if column.Required {
+				_, err := columns.lookup("required", name)
+				return nil, err
+			}
+			continue
+		}
+		checks = append(checks, columnCheck{name: name, index: i, column: column})
+	}
+	return checks, nil
+}
+
+// validateRecord checks a record against the resolved schema columns and
+// describes the first violation found.
+func validateRecord(record []string, layout rowLayout, opts Options) error {
+	for _, check := range layout.checks {
+		cell := ""
+		if check.index < len(record) {
+			cell = record[check.index]
+		}
+		if opts.Trim {
+			cell = strings.TrimSpace(cell)
+		}
+		if cell == "" || layout.isNull(cell, opts.NullCaseInsensitive) {
+			if check.column.Required {
+				return &ColumnError{Column: check.name, Err: errors.New("missing required value")}
+			}
+			continue
+		}
+
+		var err error
+		switch check.column.Type {
+		case TypeInt:
+			_, err = strconv.ParseInt(cell, 10, 64)
+		case TypeFloat:
+			_, err = strconv.ParseFloat(cell, 64)
+		case TypeBool:
+			_, err = strconv.ParseBool(cell)
+		}
+		if err != nil {
+			return &ColumnError{Column: check.name, Err: fmt.Errorf("%q is not a valid %s", cell, check.column.Type)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package converter
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// recordReader yields one record per call, like csv.Reader.
+type recordReader interface {
+	Read() ([]string, error)
+}
+
+// newRecordReader returns a csv.Reader configured from opts, or a lineSplitter
+// when opts.Widths or opts.SplitRegex is set.
+func newRecordReader(input io.Reader, opts Options) recordReader {
+	switch {
+	case len(opts.Widths) > 0:
+		return &lineSplitter{
+			input:   bufio.NewReader(input),
+			comment: opts.Comment,
+			split:   func(line string) []string { return splitWidths(line, opts.Widths) },
+		}
+	case opts.SplitRegex != nil:
+		return &lineSplitter{
+			input:   bufio.NewReader(input),
+			comment: opts.Comment,
+			split: func(line string) []string {
+				return splitRegex(line, opts.SplitRegex, opts.TrimLeadingSpace)
+			},
+		}
+	}
+	reader := csv.NewReader(input)
+	reader.Comma = opts.Delimiter
+	reader.LazyQuotes = opts.LazyQuotes
+	reader.TrimLeadingSpace = opts.TrimLeadingSpace
+	reader.Comment = opts.Comment
+
+	// Rows may be shorter or longer than the header; that is handled when
+	// building each row rather than rejected by the reader
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+// lineSplitter reads a record from each line of the input with split, for
+// formats csv.Reader can't parse. Quotes have no special meaning, so a field
+// can't contain a line break. Empty lines and comment lines are skipped, as
+// csv.Reader does.
+type lineSplitter struct {
+	input   *bufio.Reader
+	comment rune
+	split   func(line string) []string
+}
+
+func (s *lineSplitter) Read() ([]string, error) {
+	for {
+		line, err := s.input.ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return nil, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line == "" || (s.comment != 0 && strings.HasPrefix(line, string(s.comment))) {
+			continue
+		}
+		return s.split(line), nil
+	}
+}
+
+// splitRegex splits a line on the matches of separator, for separators such
+// as "||"; a field can't contain the separator.
+func splitRegex(line string, separator *regexp.Regexp, trimSpace bool) []string {
+	fields := separator.Split(line, -1)
+	if trimSpace {
+		for i := 1; i < len(fields); i++ {
+			fields[i] = strings.TrimLeftFunc(fields[i], unicode.IsSpace)
+		}
+	}
+	return fields
+}
+
+// splitWidths cuts a fixed-width line into fields of the given widths in
+// characters. A short line gives fewer fields, and any text past the last
+// width, unless blank, becomes one more field, so both are reported as a
+// field-count mismatch.
+func splitWidths(line string, widths []int) []string {
+	fields := make([]string, 0, len(widths)+1)
+	for _, width := range widths {
+		if line == "" {
+			break
+		}
+		end := len(line)
+		for i := range line {
+			if width == 0 {
+				end = i
+				break
+			}
+			width--
+		}
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+	if strings.TrimSpace(line) != "" {
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// validWidths reports whether every width is positive.
+func validWidths(widths []int) bool {
+	for _, width := range widths {
+		if width < 1 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package converter
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readState is what the reader carries from one source to the next. With
+// Options.ConcurrentSources it is shared by several readers, so mu guards
+// every field.
+type readState struct {
+	mu sync.Mutex
+	// seq is the running row number.
+	seq int
+	// sampler picks the rows kept by Options.Sample, or is nil. One
+	// generator serves every source, so a seed fixes the whole sample.
+	sampler *rand.Rand
+	// seen holds the DedupOn key of every row converted so far.
+	seen map[string]struct{}
+}
+
+func newReadState(opts Options) *readState {
+	state := &readState{}
+	if opts.Sample > 0 && opts.Sample < 1 {
+		seed := opts.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		state.sampler = rand.New(rand.NewSource(seed))
+	}
+	if len(opts.DedupOn) > 0 {
+		state.seen = make(map[string]struct{})
+	}
+	return state
+}
+
+// nextSeq returns the sequence number of the next row.
+func (s *readState) nextSeq() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return s.seq
+}
+
+// sampledOut reports whether Options.Sample leaves out the next row.
+func (s *readState) sampledOut(opts Options) bool {
+	if s.sampler == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sampler.Float64() >= opts.Sample
+}
+
+// seenBefore reports whether a row with the same values in columns has
+// already been seen, and remembers record's values if not.
+func (s *readState) seenBefore(record []string, columns []int, opts Options) bool {
+	// Each value is prefixed with its length so that no two distinct
+	// combinations of values share a key
+	var key strings.Builder
+	for _, i := range columns {
+		var cell string
+		if i < len(record) {
+			cell = record[i]
+		}
+		if opts.Trim {
+			cell = strings.TrimSpace(cell)
+		}
+		key.WriteString(strconv.Itoa(len(cell)))
+		key.WriteByte(':')
+		key.WriteString(cell)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[key.String()]; ok {
+		return true
+	}
+	s.seen[key.String()] = struct{}{}
+	return false
+}
+
+// dedupColumns resolves the DedupOn columns against a source's columns. Like
+// a date column, a missing column is an error.
+func dedupColumns(names []string, columns columnIndex) ([]int, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	indexes := make([]int, len(names))
+	for n, name := range names {
+		i, err := columns.lookup("dedup", name)
+		if err != nil {
+			return nil, err
+		}
+		indexes[n] = i
+	}
+	return indexes, nil
+}
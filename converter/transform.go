@@ -0,0 +1,218 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Transform rewrites the values of a column with a chain of steps, each
+// applied to the result of the one before. Values are transformed after
+// schema validation and date normalization, but before null values and type
+// inference apply, so a step can turn a value into one that is then written
+// as null or as a number.
+type Transform struct {
+	Column string
+	Steps  []TransformStep
+}
+
+// TransformStep is one function of a Transform: upper, lower or trim, which
+// take no arguments; replace, which takes the text to find and its
+// replacement; or substr, which takes a start and an optional length in
+// characters, counting from 0.
+type TransformStep struct {
+	Func string
+	Args []string
+}
+
+// ParseTransform parses a transform written as column:steps, where the steps
+// are function calls separated by |, such as name:trim|upper or
+// code:replace("-", "")|substr(0, 3). Arguments are bare words or
+// double-quoted strings using Go syntax; a function without arguments needs
+// no parentheses.
+func ParseTransform(spec string) (Transform, error) {
+	var t Transform
+	column, rest, ok := strings.Cut(spec, ":")
+	t.Column = strings.TrimSpace(column)
+	if !ok || t.Column == "" {
+		return t, fmt.Errorf("%q: expected column:functions", spec)
+	}
+	for {
+		step, after, err := transformStep(strings.TrimSpace(rest))
+		if err != nil {
+			return t, fmt.Errorf("%q: %w", spec, err)
+		}
+		t.Steps = append(t.Steps, step)
+		after = strings.TrimSpace(after)
+		if after == "" {
+			return t, nil
+		}
+		if after[0] != '|' {
+			return t, fmt.Errorf("%q: unexpected %q after %s", spec, after, step.Func)
+		}
+		rest = after[1:]
+	}
+}
+
+// transformStep reads a function call and checks it.
+func transformStep(s string) (TransformStep, string, error) {
+	var step TransformStep
+	end := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
+	if end < 0 {
+		end = len(s)
+	}
+	step.Func = s[:end]
+	if step.Func == "" {
+		return step, s, errors.New("missing function")
+	}
+	rest := strings.TrimSpace(s[end:])
+	if strings.HasPrefix(rest, "(") {
+		rest = strings.TrimSpace(rest[1:])
+		if strings.HasPrefix(rest, ")") {
+			rest = rest[1:]
+		} else {
+			for {
+				arg, after, err := transformArg(rest)
+				if err != nil {
+					return step, s, fmt.Errorf("%s: %w", step.Func, err)
+				}
+				step.Args = append(step.Args, arg)
+				after = strings.TrimSpace(after)
+				if strings.HasPrefix(after, ")") {
+					rest = after[1:]
+					break
+				}
+				if !strings.HasPrefix(after, ",") {
+					return step, s, fmt.Errorf("%s: expected , or ) after an argument", step.Func)
+				}
+				rest = strings.TrimSpace(after[1:])
+			}
+		}
+	}
+	if _, err := step.compile(); err != nil {
+		return step, s, err
+	}
+	return step, rest, nil
+}
+
+// transformArg reads a double-quoted string, or else a bare word ending at
+// the next comma or closing parenthesis.
+func transformArg(s string) (string, string, error) {
+	if strings.HasPrefix(s, `"`) {
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", "", err
+		}
+		arg, err := strconv.Unquote(quoted)
+		return arg, s[len(quoted):], err
+	}
+	end := strings.IndexAny(s, ",)")
+	if end < 0 {
+		return "", "", errors.New("missing )")
+	}
+	arg := strings.TrimSpace(s[:end])
+	if arg == "" {
+		return "", "", errors.New("missing argument")
+	}
+	return arg, s[end:], nil
+}
+
+// compile checks the step's function and arguments and returns the function
+// it applies to a value.
+func (s TransformStep) compile() (func(string) string, error) {
+	switch s.Func {
+	case "upper", "lower", "trim":
+		if len(s.Args) != 0 {
+			return nil, fmt.Errorf("%s takes no arguments, got %d", s.Func, len(s.Args))
+		}
+		switch s.Func {
+		case "upper":
+			return strings.ToUpper, nil
+		case "lower":
+			return strings.ToLower, nil
+		}
+		return strings.TrimSpace, nil
+	case "replace":
+		if len(s.Args) != 2 {
+			return nil, fmt.Errorf("replace takes 2 arguments, the text to find and its replacement; got %d", len(s.Args))
+		}
+		old, replacement := s.Args[0], s.Args[1]
+		if old == "" {
+			return nil, errors.New("replace: the text to find must not be empty")
+		}
+		return func(value string) string { return strings.ReplaceAll(value, old, replacement) }, nil
+	case "substr":
+		if len(s.Args) != 1 && len(s.Args) != 2 {
+			return nil, fmt.Errorf("substr takes 1 or 2 arguments, a start and an optional length; got %d", len(s.Args))
+		}
+		bounds := make([]int, len(s.Args))
+		for i, arg := range s.Args {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("substr: %q is not a non-negative whole number", arg)
+			}
+			bounds[i] = n
+		}
+		return func(value string) string {
+			runes := []rune(value)
+			start, end := bounds[0], len(runes)
+			if start >= end {
+				return ""
+			}
+			if len(bounds) == 2 && start+bounds[1] < end {
+				end = start + bounds[1]
+			}
+			return string(runes[start:end])
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown function %q; expected upper, lower, trim, replace or substr", s.Func)
+	}
+}
+
+// columnTransform is a Transform resolved to its column's index and
+// compiled.
+type columnTransform struct {
+	index int
+	steps []func(string) string
+}
+
+// transformColumns resolves the transforms against a source's columns. Like
+// a date column, a missing column is an error.
+func transformColumns(transforms []Transform, columns columnIndex) ([]columnTransform, error) {
+	if len(transforms) == 0 {
+		return nil, nil
+	}
+	resolved := make([]columnTransform, len(transforms))
+	for n, t := range transforms {
+		i, err := columns.lookup("transform", t.Column)
+		if err != nil {
+			return nil, err
+		}
+		resolved[n].index = i
+		for _, step := range t.Steps {
+			apply, err := step.compile()
+			if err != nil {
+				return nil, &ColumnError{Column: t.Column, Err: err}
+			}
+			resolved[n].steps = append(resolved[n].steps, apply)
+		}
+	}
+	return resolved, nil
+}
+
+// applyTransforms returns a copy of the record with the transformed columns
+// rewritten. A field missing from a short record stays missing.
+func applyTransforms(record []string, transforms []columnTransform) []string {
+	record = append([]string(nil), record...)
+	for _, t := range transforms {
+		if t.index >= len(record) {
+			continue
+		}
+		for _, apply := range t.steps {
+			record[t.index] = apply(record[t.index])
+		}
+	}
+	return record
+}
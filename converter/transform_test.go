@@ -0,0 +1,124 @@
+package converter
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTransform(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Transform
+		err  string
+	}{
+		{spec: "name:upper", want: Transform{"name", []TransformStep{{Func: "upper"}}}},
+		{spec: " name : trim | lower() ", want: Transform{"name", []TransformStep{{Func: "trim"}, {Func: "lower"}}}},
+		{spec: `code:replace("-", "")|substr(0, 3)`, want: Transform{"code", []TransformStep{
+			{Func: "replace", Args: []string{"-", ""}},
+			{Func: "substr", Args: []string{"0", "3"}},
+		}}},
+		// Quoted arguments may hold the separators
+		{spec: `a:replace(",", "|")`, want: Transform{"a", []TransformStep{{Func: "replace", Args: []string{",", "|"}}}}},
+		{spec: `a:replace(" x ", "\"")`, want: Transform{"a", []TransformStep{{Func: "replace", Args: []string{" x ", `"`}}}}},
+		{spec: "a:replace( x , y )", want: Transform{"a", []TransformStep{{Func: "replace", Args: []string{"x", "y"}}}}},
+		{spec: "name", err: "expected column:functions"},
+		{spec: ":upper", err: "expected column:functions"},
+		{spec: "name:", err: "missing function"},
+		{spec: "name:upper|", err: "missing function"},
+		{spec: "name:upper lower", err: `unexpected "lower" after upper`},
+		{spec: "name:title", err: `unknown function "title"`},
+		{spec: "name:upper(x)", err: "upper takes no arguments, got 1"},
+		{spec: "name:replace(x)", err: "replace takes 2 arguments"},
+		{spec: `name:replace("", y)`, err: "the text to find must not be empty"},
+		{spec: "name:substr()", err: "substr takes 1 or 2 arguments"},
+		{spec: "name:substr(-1)", err: `"-1" is not a non-negative whole number`},
+		{spec: "name:substr(0 3)", err: `"0 3" is not a non-negative whole number`},
+		{spec: "name:substr(0", err: "missing )"},
+		{spec: "name:replace(x,)", err: "missing argument"},
+		{spec: `name:replace("x" y)`, err: "expected , or ) after an argument"},
+	}
+	for _, tt := range tests {
+		got, err := ParseTransform(tt.spec)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseTransform(%q) error = %v, want one containing %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTransform(%q): %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTransform(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestApplyTransforms(t *testing.T) {
+	tests := []struct {
+		spec  string
+		value string
+		want  string
+	}{
+		{"v:upper", "Ann Lee", "ANN LEE"},
+		{"v:lower", "ÅSA", "åsa"},
+		{"v:trim|upper", "  ann  ", "ANN"},
+		{"v:upper|trim", "  ann  ", "ANN"},
+		{`v:replace("-", "")`, "12-34-56", "123456"},
+		{`v:replace("-", "")|substr(0, 3)`, "12-34-56", "123"},
+		{`v:substr(0, 3)|replace("-", "")`, "12-34-56", "12"},
+		// substr counts characters, not bytes, and stops at the end
+		{"v:substr(1, 2)", "émile", "mi"},
+		{"v:substr(2)", "émile", "ile"},
+		{"v:substr(3, 10)", "émile", "le"},
+		{"v:substr(5)", "émile", ""},
+		{"v:substr(9, 1)", "émile", ""},
+		{"v:upper", "", ""},
+	}
+	for _, tt := range tests {
+		transform, err := ParseTransform(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolved, err := transformColumns([]Transform{transform}, newColumnIndex([]string{"id", "v"}, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := []string{"1", tt.value}
+		got := applyTransforms(record, resolved)
+		if got[1] != tt.want {
+			t.Errorf("%s on %q = %q, want %q", tt.spec, tt.value, got[1], tt.want)
+		}
+		if record[1] != tt.value {
+			t.Errorf("%s rewrote the input record", tt.spec)
+		}
+	}
+
+	// A field missing from a short record stays missing
+	resolved, err := transformColumns([]Transform{{Column: "v", Steps: []TransformStep{{Func: "upper"}}}}, newColumnIndex([]string{"id", "v"}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := applyTransforms([]string{"1"}, resolved); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("short record = %q, want [1]", got)
+	}
+}
+
+func TestTransformColumnErrors(t *testing.T) {
+	columns := newColumnIndex([]string{"id", "name"}, "")
+	_, err := transformColumns([]Transform{{Column: "nope", Steps: []TransformStep{{Func: "upper"}}}}, columns)
+	want := `transform column "nope" not found; available columns: id, name`
+	if err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %q", err, want)
+	}
+
+	// A Transform built without ParseTransform is checked when resolved
+	_, err = transformColumns([]Transform{{Column: "name", Steps: []TransformStep{{Func: "reverse"}}}}, columns)
+	var colErr *ColumnError
+	if !errors.As(err, &colErr) || colErr.Column != "name" {
+		t.Errorf("err = %v, want a ColumnError for name", err)
+	}
+}
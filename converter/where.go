@@ -0,0 +1,178 @@
+package converter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Condition operators accepted by ParseCondition.
+const (
+	OpEqual        = "=="
+	OpNotEqual     = "!="
+	OpLess         = "<"
+	OpLessEqual    = "<="
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpContains     = "contains"
+)
+
+// Condition is a test of one column's value, such as status == "active".
+// A row must pass every condition in Options.Where to be converted.
+//
+// Values compare as numbers when both the cell and Value parse as numbers,
+// and as strings otherwise, byte by byte. OpContains looks for Value as a
+// substring. A cell is compared as read, after Trim but before null values,
+// type inference or date normalization apply.
+type Condition struct {
+	Column string
+	Op     string
+	Value  string
+}
+
+// ParseCondition parses a condition written as: column op value. The column
+// is a bare name or a double-quoted string, op is one of ==, !=, <, <=, >, >=
+// or contains, and the value is the rest of the expression, optionally
+// double-quoted. Quoted strings use Go syntax, so \" is a quote.
+func ParseCondition(expr string) (Condition, error) {
+	var c Condition
+	rest := strings.TrimSpace(expr)
+
+	column, rest, err := conditionOperand(rest, true)
+	if err != nil {
+		return c, fmt.Errorf("%q: column: %w", expr, err)
+	}
+	c.Column = column
+
+	rest = strings.TrimSpace(rest)
+	// Longer operators first, so <= isn't read as <
+	for _, op := range []string{OpEqual, OpNotEqual, OpLessEqual, OpGreaterEqual, OpLess, OpGreater, OpContains} {
+		if strings.HasPrefix(rest, op) {
+			c.Op = op
+			rest = rest[len(op):]
+			break
+		}
+	}
+	if c.Op == "" {
+		return c, fmt.Errorf("%q: expected one of ==, !=, <, <=, >, >= or contains after %q", expr, c.Column)
+	}
+	if c.Op == OpContains && rest != "" && rest[0] != ' ' && rest[0] != '"' {
+		return c, fmt.Errorf("%q: expected a space after contains", expr)
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return c, fmt.Errorf("%q: missing value", expr)
+	}
+	value, rest, err := conditionOperand(rest, false)
+	if err != nil {
+		return c, fmt.Errorf("%q: value: %w", expr, err)
+	}
+	if strings.TrimSpace(rest) != "" {
+		return c, fmt.Errorf("%q: unexpected %q after the value", expr, strings.TrimSpace(rest))
+	}
+	c.Value = value
+	return c, nil
+}
+
+// conditionOperand reads a double-quoted string, or else a bare word ending
+// at the first space or operator character when it is a column, or at the
+// end of the expression when it is a value.
+func conditionOperand(s string, column bool) (string, string, error) {
+	if strings.HasPrefix(s, `"`) {
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", "", err
+		}
+		value, err := strconv.Unquote(quoted)
+		return value, s[len(quoted):], err
+	}
+	end := len(s)
+	if column {
+		if i := strings.IndexAny(s, " =!<>"); i >= 0 {
+			end = i
+		}
+	}
+	if end == 0 {
+		return "", "", fmt.Errorf("missing")
+	}
+	return s[:end], s[end:], nil
+}
+
+// whereCheck is a Condition resolved to its column's index.
+type whereCheck struct {
+	Condition
+	index  int
+	number float64
+	// numeric is set when Value parses as a number.
+	numeric bool
+}
+
+// whereChecks resolves the conditions against a source's columns. Like a
+// date column, a missing column is an error.
+func whereChecks(conditions []Condition, columns columnIndex) ([]whereCheck, error) {
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+	checks := make([]whereCheck, len(conditions))
+	for n, c := range conditions {
+		i, err := columns.lookup("where", c.Column)
+		if err != nil {
+			return nil, err
+		}
+		checks[n] = whereCheck{Condition: c, index: i}
+		if f, err := strconv.ParseFloat(c.Value, 64); err == nil {
+			checks[n].number, checks[n].numeric = f, true
+		}
+	}
+	return checks, nil
+}
+
+// matches reports whether record passes every check. A field missing from a
+// short record is taken as empty.
+func matches(record []string, checks []whereCheck, opts Options) bool {
+	for _, check := range checks {
+		var cell string
+		if check.index < len(record) {
+			cell = record[check.index]
+		}
+		if opts.Trim {
+			cell = strings.TrimSpace(cell)
+		}
+		if !check.test(cell) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c whereCheck) test(cell string) bool {
+	if c.Op == OpContains {
+		return strings.Contains(cell, c.Value)
+	}
+	var cmp int
+	if f, err := strconv.ParseFloat(cell, 64); err == nil && c.numeric {
+		switch {
+		case f < c.number:
+			cmp = -1
+		case f > c.number:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(cell, c.Value)
+	}
+	switch c.Op {
+	case OpEqual:
+		return cmp == 0
+	case OpNotEqual:
+		return cmp != 0
+	case OpLess:
+		return cmp < 0
+	case OpLessEqual:
+		return cmp <= 0
+	case OpGreater:
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
@@ -0,0 +1,136 @@
+package converter
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		expr string
+		want Condition
+		err  string
+	}{
+		{expr: "status == active", want: Condition{"status", OpEqual, "active"}},
+		{expr: "  status!=active  ", want: Condition{"status", OpNotEqual, "active"}},
+		// Two-character operators are not read as their first character
+		{expr: "age<=30", want: Condition{"age", OpLessEqual, "30"}},
+		{expr: "age >= 30", want: Condition{"age", OpGreaterEqual, "30"}},
+		{expr: "age < 30", want: Condition{"age", OpLess, "30"}},
+		{expr: "age>30", want: Condition{"age", OpGreater, "30"}},
+		{expr: "age < =30", want: Condition{"age", OpLess, "=30"}},
+		{expr: "name contains  Ann", want: Condition{"name", OpContains, "Ann"}},
+		{expr: `name contains"Ann"`, want: Condition{"name", OpContains, "Ann"}},
+		// A bare value runs to the end, spaces and operators included
+		{expr: "city == New York", want: Condition{"city", OpEqual, "New York"}},
+		{expr: "note == a == b", want: Condition{"note", OpEqual, "a == b"}},
+		{expr: `"first name" == "Ann \"Annie\" Lee"`, want: Condition{"first name", OpEqual, `Ann "Annie" Lee`}},
+		{expr: `"a<b" contains "\t"`, want: Condition{"a<b", OpContains, "\t"}},
+		{expr: `code == ""x`, err: `unexpected "x" after the value`},
+		{expr: "name containsAnn", err: "expected a space after contains"},
+		{expr: "status = active", err: "expected one of"},
+		{expr: "status", err: "expected one of"},
+		{expr: "== active", err: "column: missing"},
+		{expr: "status ==", err: "missing value"},
+		{expr: `"status == active`, err: "column:"},
+		{expr: `status == "active`, err: "value:"},
+	}
+	for _, tt := range tests {
+		got, err := ParseCondition(tt.expr)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseCondition(%q) error = %v, want one containing %q", tt.expr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCondition(%q): %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseCondition(%q) = %+v, want %+v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestConditionMatches(t *testing.T) {
+	tests := []struct {
+		expr string
+		cell string
+		want bool
+	}{
+		// Numbers compare by value when both sides are numbers
+		{"n > 9", "10", true},
+		{"n < 9", "10", false},
+		{"n == 1.0", "1", true},
+		{"n >= -2", "-2", true},
+		{"n != 1e3", "1000", false},
+		// and as strings otherwise
+		{"n > 9", "abc", true},
+		{"s > 9", "10", true},
+		{"s < b", "a", true},
+		{"s <= b", "b", true},
+		{"s == Ann", "ann", false},
+		{"s != Ann", "ann", true},
+		{"s contains nn", "Ann", true},
+		{"s contains 1", "10", true},
+		{"s contains x", "", false},
+		{`s == ""`, "", true},
+	}
+	for _, tt := range tests {
+		c, err := ParseCondition(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checks, err := whereChecks([]Condition{c}, newColumnIndex([]string{"n", "s"}, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := []string{tt.cell, tt.cell}
+		if got := matches(record, checks, Options{}); got != tt.want {
+			t.Errorf("%s with %q = %v, want %v", tt.expr, tt.cell, got, tt.want)
+		}
+	}
+}
+
+func TestConditionTrimAndShortRecord(t *testing.T) {
+	c, err := ParseCondition("b == x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks, err := whereChecks([]Condition{c}, newColumnIndex([]string{"a", "b"}, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches([]string{"1", " x "}, checks, Options{}) {
+		t.Error("untrimmed cell matched")
+	}
+	if !matches([]string{"1", " x "}, checks, Options{Trim: true}) {
+		t.Error("trimmed cell didn't match")
+	}
+	// The missing field is taken as empty
+	if matches([]string{"1"}, checks, Options{}) {
+		t.Error("missing field matched")
+	}
+	if c, err = ParseCondition(`b == ""`); err != nil {
+		t.Fatal(err)
+	}
+	checks[0] = whereCheck{Condition: c, index: 1}
+	if !matches([]string{"1"}, checks, Options{}) {
+		t.Error("missing field isn't empty")
+	}
+}
+
+func TestWhereUnknownColumn(t *testing.T) {
+	c, err := ParseCondition("status == active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Convert(context.Background(), strings.NewReader("id,state\n1,active\n"), io.Discard, Options{Where: []Condition{c}})
+	want := `where column "status" not found; available columns: id, state`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("err = %v, want one containing %q", err, want)
+	}
+}
@@ -0,0 +1,559 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rowWriter serializes rows to the output in the selected format. Rows are
+// first passed through encode, which is safe for concurrent use, so workers
+// can do the costly marshalling in parallel; write is not, and is only called
+// from the single goroutine that owns the output.
+//
+// When ordered is set, rows are held in a reorder buffer keyed by sequence
+// number and emitted only once every preceding row has been written. Workers
+// finish out of order, so in the worst case the buffer holds every row that
+// completed ahead of a slow one; memory grows with that gap rather than the
+// file size.
+type rowWriter struct {
+	out     io.Writer
+	format  string
+	written int
+
+	// When splitRows is set, the output rolls over to the writer returned
+	// by nextPart once the current part holds that many rows. partWritten
+	// counts the rows in the current part and drives its framing.
+	splitRows   int
+	nextPart    func(part int) (io.Writer, error)
+	part        int
+	partWritten int
+
+	// csvOut and csvHeader are used by FormatCSV. The header is taken from
+	// the first row written.
+	csvOut    *csv.Writer
+	csvHeader []string
+
+	// indent, when set, pretty-prints JSON rows.
+	indent string
+
+	// preserveOrder writes JSON keys in header order rather than sorted.
+	preserveOrder bool
+
+	// yamlSequence writes every FormatYAML row as an item of a single
+	// top-level list instead of a document of its own.
+	yamlSequence bool
+
+	// batch collects encoded FormatJSONL rows until batchSize of them can
+	// be written as one array.
+	batch     [][]byte
+	batchSize int
+
+	// actionLine precedes each FormatJSONL row on a line of its own.
+	actionLine string
+
+	// sink, when set, takes each row instead of any format.
+	sink func(fields []string, row map[string]interface{}) error
+
+	// When partitionBy is set, each row goes to the output for its value
+	// of that key, opened by openPartition on first use, and out is unused.
+	// The state of the current partition's output lives in the fields
+	// above and is swapped with that of the next row's partition as
+	// needed, so the format code is the same with or without partitions.
+	partitionBy   string
+	openPartition func(value string) (io.Writer, error)
+	partitions    map[string]*partitionState
+	partition     *partitionState
+
+	ordered bool
+	nextSeq int
+	pending map[int]task
+}
+
+func newRowWriter(out io.Writer, opts Options) *rowWriter {
+	w := &rowWriter{
+		format:        opts.Format,
+		splitRows:     opts.SplitRows,
+		nextPart:      opts.NextPart,
+		indent:        opts.Indent,
+		preserveOrder: opts.PreserveOrder,
+		yamlSequence:  opts.YAMLSequence,
+		batchSize:     opts.BatchSize,
+		actionLine:    opts.ActionLine,
+		sink:          opts.Sink,
+		partitionBy:   opts.PartitionBy,
+		openPartition: opts.OpenPartition,
+		partitions:    make(map[string]*partitionState),
+		ordered:       opts.Ordered,
+		nextSeq:       1,
+		pending:       make(map[int]task),
+	}
+	w.setOutput(out)
+	return w
+}
+
+// setOutput directs the writer at out, starting a new part.
+func (w *rowWriter) setOutput(out io.Writer) {
+	w.out = out
+	w.partWritten = 0
+	if w.format == FormatCSV {
+		// Each part gets its own header
+		w.csvOut = csv.NewWriter(out)
+		w.csvHeader = nil
+	}
+}
+
+// rollover finishes the current part and begins the next one.
+func (w *rowWriter) rollover() error {
+	if err := w.finish(); err != nil {
+		return err
+	}
+	w.part++
+	out, err := w.nextPart(w.part)
+	if err != nil {
+		return err
+	}
+	w.setOutput(out)
+	return w.begin()
+}
+
+// partitionState is the output state of a partition while the writer is
+// busy with another one.
+type partitionState struct {
+	value       string
+	out         io.Writer
+	partWritten int
+	csvOut      *csv.Writer
+	csvHeader   []string
+	batch       [][]byte
+}
+
+// usePartition makes the output for value the current one, opening it and
+// writing its leading framing the first time.
+func (w *rowWriter) usePartition(value string) error {
+	if w.partition != nil {
+		if w.partition.value == value {
+			return nil
+		}
+		w.partition.out, w.partition.partWritten = w.out, w.partWritten
+		w.partition.csvOut, w.partition.csvHeader = w.csvOut, w.csvHeader
+		w.partition.batch = w.batch
+	}
+	if p, ok := w.partitions[value]; ok {
+		w.partition = p
+		w.out, w.partWritten = p.out, p.partWritten
+		w.csvOut, w.csvHeader = p.csvOut, p.csvHeader
+		w.batch = p.batch
+		return nil
+	}
+
+	out, err := w.openPartition(value)
+	if err != nil {
+		return err
+	}
+	w.partition = &partitionState{value: value}
+	w.partitions[value] = w.partition
+	w.setOutput(out)
+	w.batch = nil
+	return w.begin()
+}
+
+// partitionValue is the text of a row's partition value: empty for a
+// missing or null value, and as written to CSV otherwise.
+func partitionValue(value interface{}) string {
+	text, _ := csvValue(value)
+	return text
+}
+
+// begin writes any framing that precedes the first row.
+func (w *rowWriter) begin() error {
+	if w.partitionBy != "" && w.partition == nil {
+		// Each partition's framing is written when it is opened
+		return nil
+	}
+	if w.format == FormatJSONArray && w.sink == nil {
+		_, err := io.WriteString(w.out, "[")
+		return err
+	}
+	return nil
+}
+
+// write emits t, or holds it until its turn when ordered. A task with a nil
+// Row marks a sequence number that was skipped and produces no output.
+func (w *rowWriter) write(t task) error {
+	if !w.ordered {
+		return w.emit(t)
+	}
+
+	w.pending[t.Seq] = t
+	for {
+		next, ok := w.pending[w.nextSeq]
+		if !ok {
+			return nil
+		}
+		delete(w.pending, w.nextSeq)
+		w.nextSeq++
+		if err := w.emit(next); err != nil {
+			return err
+		}
+	}
+}
+
+// encode marshals t.Row into t.Data, or its CSV values into t.Record. It
+// only reads the writer's settings, so workers may call it concurrently.
+func (w *rowWriter) encode(t task) (task, error) {
+	if t.Row == nil || w.sink != nil {
+		return t, nil
+	}
+
+	var err error
+	switch w.format {
+	case FormatJSONArray:
+		// Elements sit one level inside the array
+		t.Data, err = w.marshalJSON(t, w.indent)
+	case FormatCSV:
+		t.Record = make([]string, len(t.Fields))
+		for i, key := range t.Fields {
+			if t.Record[i], err = csvValue(t.Row[key]); err != nil {
+				break
+			}
+		}
+	case FormatYAML:
+		t.Data, err = encodeYAML(t.Row, w.yamlSequence)
+	default:
+		t.Data, err = w.marshalJSON(t, "")
+	}
+	return t, err
+}
+
+// marshalJSON encodes t.Row for the JSON formats, indented after prefix when
+// indent is set.
+func (w *rowWriter) marshalJSON(t task, prefix string) ([]byte, error) {
+	if !w.preserveOrder {
+		if w.indent == "" {
+			return json.Marshal(t.Row)
+		}
+		return json.MarshalIndent(t.Row, prefix, w.indent)
+	}
+	data, err := marshalOrdered(t.Row, t.Fields)
+	if err != nil || w.indent == "" {
+		return data, err
+	}
+	var buf bytes.Buffer
+	err = json.Indent(&buf, data, prefix, w.indent)
+	return buf.Bytes(), err
+}
+
+// marshalOrdered encodes row as a JSON object with its keys in the order of
+// fields, followed by any others sorted. Nested objects keep json.Marshal's
+// sorted keys.
+func marshalOrdered(row map[string]interface{}, fields []string) ([]byte, error) {
+	keys := make([]string, 0, len(row))
+	listed := make(map[string]bool, len(fields))
+	for _, key := range fields {
+		if _, ok := row[key]; ok && !listed[key] {
+			listed[key] = true
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) < len(row) {
+		var others []string
+		for key := range row {
+			if !listed[key] {
+				others = append(others, key)
+			}
+		}
+		sort.Strings(others)
+		keys = append(keys, others...)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(row[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// encodeYAML marshals row as a document, or as a one-item list in sequence
+// mode; such lists concatenate into a single list.
+func encodeYAML(row map[string]interface{}, sequence bool) ([]byte, error) {
+	if sequence {
+		return yaml.Marshal([]interface{}{row})
+	}
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(row); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// emit writes an encoded row to the current part, rolling over to the next
+// part first when the current one is full.
+func (w *rowWriter) emit(t task) error {
+	if t.Row == nil {
+		return nil
+	}
+	if w.partitionBy != "" {
+		if err := w.usePartition(partitionValue(t.Row[w.partitionBy])); err != nil {
+			return err
+		}
+	}
+	if w.splitRows > 0 && w.partWritten == w.splitRows {
+		if err := w.rollover(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch {
+	case w.sink != nil:
+		err = w.sink(t.Fields, t.Row)
+	case w.format == FormatJSONArray:
+		err = w.emitArrayElement(t.Data)
+	case w.format == FormatCSV:
+		err = w.emitCSV(t)
+	case w.format == FormatYAML:
+		err = w.emitYAML(t.Data)
+	default:
+		err = w.emitJSONL(t.Data)
+	}
+	if err != nil {
+		return err
+	}
+	w.written++
+	w.partWritten++
+	return nil
+}
+
+// emitJSONL writes the row as a line of its own, after the action line if
+// any, or adds it to the current batch and writes the batch once it is full.
+func (w *rowWriter) emitJSONL(data []byte) error {
+	if w.actionLine != "" {
+		return w.writeWithPrefix(w.actionLine+"\n", append(data, '\n'))
+	}
+	if w.batchSize == 0 {
+		return w.writeLine(data)
+	}
+	w.batch = append(w.batch, data)
+	if len(w.batch) < w.batchSize {
+		return nil
+	}
+	return w.flushBatch()
+}
+
+// flushBatch writes the rows batched so far as a single JSON array.
+func (w *rowWriter) flushBatch() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	data := append([]byte("["), bytes.Join(w.batch, []byte(","))...)
+	w.batch = w.batch[:0]
+	return w.writeLine(append(data, ']'))
+}
+
+// writeLine writes data followed by a newline in a single write.
+func (w *rowWriter) writeLine(data []byte) error {
+	_, err := w.out.Write(append(data, '\n'))
+	return err
+}
+
+// emitArrayElement streams the row as the next element of the array opened by
+// begin, so the array is never held in memory. Whether a comma is needed
+// depends on partWritten, which is only safe because a single goroutine
+// writes.
+func (w *rowWriter) emitArrayElement(data []byte) error {
+	// Every element after the first is preceded by a comma
+	sep := "\n" + w.indent
+	if w.partWritten > 0 {
+		sep = "," + sep
+	}
+	return w.writeWithPrefix(sep, data)
+}
+
+// emitCSV writes the row's values in header order, writing the header itself
+// first. Keys not in the first row's header are dropped and missing ones are
+// left empty.
+func (w *rowWriter) emitCSV(t task) error {
+	if w.csvHeader == nil {
+		w.csvHeader = t.Fields
+		if err := w.csvOut.Write(w.csvHeader); err != nil {
+			return err
+		}
+	}
+	if sameFields(t.Fields, w.csvHeader) {
+		return w.csvOut.Write(t.Record)
+	}
+
+	// A later source with different columns is mapped onto the header
+	index := make(map[string]int, len(t.Fields))
+	for i, key := range t.Fields {
+		index[key] = i
+	}
+	record := make([]string, len(w.csvHeader))
+	for i, key := range w.csvHeader {
+		if j, ok := index[key]; ok {
+			record[i] = t.Record[j]
+		}
+	}
+	return w.csvOut.Write(record)
+}
+
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// emitYAML writes the row as its own document, separated from the previous
+// one with "---", or as the next item of a sequence.
+func (w *rowWriter) emitYAML(data []byte) error {
+	if !w.yamlSequence && w.partWritten > 0 {
+		return w.writeWithPrefix("---\n", data)
+	}
+	_, err := w.out.Write(data)
+	return err
+}
+
+// writeWithPrefix writes prefix and data together, as one write to what is
+// often an unbuffered file.
+func (w *rowWriter) writeWithPrefix(prefix string, data []byte) error {
+	buf := make([]byte, 0, len(prefix)+len(data))
+	buf = append(buf, prefix...)
+	_, err := w.out.Write(append(buf, data...))
+	return err
+}
+
+// csvValue formats a row value as a CSV field. Scalars are written as plain
+// text and nested objects or lists as JSON.
+func csvValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		data, err := json.Marshal(v)
+		return string(data), err
+	}
+}
+
+// end flushes any rows still held for ordering, writes the record returned
+// by trailer if set, and finishes the last part.
+func (w *rowWriter) end(trailer func() map[string]interface{}) error {
+	// Whatever remains sits behind a gap in sequence numbers; emit it in order
+	seqs := make([]int, 0, len(w.pending))
+	for seq := range w.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		if err := w.emit(w.pending[seq]); err != nil {
+			return err
+		}
+		delete(w.pending, seq)
+	}
+	if trailer != nil {
+		if err := w.emitTrailer(trailer()); err != nil {
+			return err
+		}
+	}
+	if w.partitionBy == "" {
+		return w.finish()
+	}
+	values := make([]string, 0, len(w.partitions))
+	for value := range w.partitions {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		if err := w.usePartition(value); err != nil {
+			return err
+		}
+		if err := w.finish(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitTrailer encodes and writes row after the last row, framed like one but
+// not counted in written.
+func (w *rowWriter) emitTrailer(row map[string]interface{}) error {
+	t, err := w.encode(task{Row: row})
+	if err != nil {
+		return fmt.Errorf("writing trailer: %w", err)
+	}
+	if err := w.emit(t); err != nil {
+		return fmt.Errorf("writing trailer: %w", err)
+	}
+	w.written--
+	return nil
+}
+
+// finish writes the framing that follows the last row of the current part.
+func (w *rowWriter) finish() error {
+	if w.sink != nil {
+		return nil
+	}
+	switch w.format {
+	case FormatJSONL:
+		// The last batch is usually short
+		return w.flushBatch()
+	case FormatJSONArray:
+		closing := "]\n"
+		if w.partWritten > 0 {
+			closing = "\n" + closing
+		}
+		_, err := io.WriteString(w.out, closing)
+		return err
+	case FormatCSV:
+		w.csvOut.Flush()
+		return w.csvOut.Error()
+	case FormatYAML:
+		// An empty stream of documents is already valid YAML, but an empty
+		// sequence must be spelled out
+		if w.yamlSequence && w.partWritten == 0 {
+			_, err := io.WriteString(w.out, "[]\n")
+			return err
+		}
+	}
+	return nil
+}
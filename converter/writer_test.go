@@ -0,0 +1,229 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// watchedBuffer collects output, closing streaming once more than threshold
+// bytes have been written.
+type watchedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	threshold int
+	streaming chan struct{}
+}
+
+func (w *watchedBuffer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	before := w.buf.Len()
+	n, err := w.buf.Write(p)
+	if before <= w.threshold && w.buf.Len() > w.threshold {
+		close(w.streaming)
+	}
+	return n, err
+}
+
+func TestJSONArrayOrderedStreaming(t *testing.T) {
+	const rows = 100000
+
+	// The input is only half written until rows have come out of the
+	// other end, which they can't if the array is held in memory
+	input, feed := io.Pipe()
+	out := &watchedBuffer{threshold: 1000, streaming: make(chan struct{})}
+	go func() {
+		fmt.Fprintln(feed, "id,name")
+		for i := 1; i <= rows; i++ {
+			if i == rows/2 {
+				select {
+				case <-out.streaming:
+				case <-time.After(10 * time.Second):
+					feed.CloseWithError(fmt.Errorf("no output after %d rows of input", i))
+					return
+				}
+			}
+			fmt.Fprintf(feed, "%d,name%d\n", i, i)
+		}
+		feed.Close()
+	}()
+
+	stats, err := Convert(context.Background(), input, out, Options{Workers: 8, Ordered: true, Format: FormatJSONArray, InferTypes: true})
+	if err != nil {
+		t.Fatalf("Convert: %v", err)
+	}
+	if stats.Written != rows {
+		t.Fatalf("wrote %d rows, want %d", stats.Written, rows)
+	}
+
+	data := out.buf.Bytes()
+	if !json.Valid(data) {
+		t.Fatal("output is not valid JSON")
+	}
+	var got []struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != rows {
+		t.Fatalf("array has %d elements, want %d", len(got), rows)
+	}
+	for i, row := range got {
+		if row.ID != i+1 {
+			t.Fatalf("element %d has id %d, want %d", i, row.ID, i+1)
+		}
+	}
+}
+
+// BenchmarkConvertFormats measures the encoding of each format, done by the
+// workers, with one worker and with several sharing the single writer.
+func BenchmarkConvertFormats(b *testing.B) {
+	const rows = 20000
+	input := syntheticCSV(rows)
+	tasks := syntheticTasks(b, input)
+	for _, format := range []string{FormatJSONL, FormatJSONArray, FormatCSV, FormatYAML} {
+		for _, workers := range []int{1, 8} {
+			b.Run(fmt.Sprintf("%s/workers=%d", format, workers), func(b *testing.B) {
+				benchmarkConvert(b, input, rows, Options{Workers: workers, Format: format, InferTypes: true})
+			})
+
+			// The baseline encodes under the lock, one row at a time, as
+			// the workers did before encoding moved out of it
+			for _, locked := range []bool{true, false} {
+				name := "encode=workers"
+				if locked {
+					name = "encode=locked"
+				}
+				b.Run(fmt.Sprintf("%s/workers=%d/%s", format, workers, name), func(b *testing.B) {
+					benchmarkEncode(b, tasks, Options{Format: format}, workers, locked)
+				})
+			}
+		}
+	}
+}
+
+// syntheticTasks parses input into the tasks the readers would hand to the
+// workers.
+func syntheticTasks(b *testing.B, input string) []task {
+	records, err := csv.NewReader(strings.NewReader(input)).ReadAll()
+	if err != nil {
+		b.Fatal(err)
+	}
+	header := records[0]
+	tasks := make([]task, 0, len(records)-1)
+	for i, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for j, key := range header {
+			row[key] = record[j]
+		}
+		tasks = append(tasks, task{Row: row, Fields: header, Line: i + 2, Seq: i + 1})
+	}
+	return tasks
+}
+
+// benchmarkEncode encodes and writes tasks with workers goroutines sharing a
+// rowWriter behind a mutex. With locked set each row is encoded while the
+// mutex is held, otherwise only the write is.
+func benchmarkEncode(b *testing.B, tasks []task, opts Options, workers int, locked bool) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writer := newRowWriter(io.Discard, opts)
+		if err := writer.begin(); err != nil {
+			b.Fatal(err)
+		}
+
+		queue := make(chan task, len(tasks))
+		for _, t := range tasks {
+			queue <- t
+		}
+		close(queue)
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var writeErr error
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for t := range queue {
+					var err error
+					if !locked {
+						t, err = writer.encode(t)
+					}
+					mu.Lock()
+					if locked {
+						t, err = writer.encode(t)
+					}
+					if err == nil {
+						err = writer.write(t)
+					}
+					if err != nil && writeErr == nil {
+						writeErr = err
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if writeErr != nil {
+			b.Fatal(writeErr)
+		}
+		if err := writer.end(nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(tasks))*float64(b.N)/b.Elapsed().Seconds(), "rows/s")
+}
+
+func TestJSONArrayValidWhenStopped(t *testing.T) {
+	// The rows written before a failure or a cancellation are closed into a
+	// valid array
+	input := syntheticCSV(5000)
+	malformed := strings.Replace(input, "\n2500,", "\n2500,\"unterminated", 1)
+	for _, indent := range []string{"", "  "} {
+		t.Run(fmt.Sprintf("indent=%q/error", indent), func(t *testing.T) {
+			var out bytes.Buffer
+			opts := Options{Workers: 4, Format: FormatJSONArray, Indent: indent, Strict: true}
+			stats, err := Convert(context.Background(), strings.NewReader(malformed), &out, opts)
+			var rowErr *RowError
+			if !errors.As(err, &rowErr) {
+				t.Fatalf("err = %v, want a RowError", err)
+			}
+			if !json.Valid(out.Bytes()) {
+				t.Fatalf("output is not valid JSON:\n%s", out.String())
+			}
+			if stats.Written == 0 {
+				t.Error("no rows were written before the error")
+			}
+		})
+		t.Run(fmt.Sprintf("indent=%q/cancelled", indent), func(t *testing.T) {
+			var out bytes.Buffer
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			read := 0
+			opts := Options{Workers: 4, Format: FormatJSONArray, Indent: indent, Progress: func() {
+				if read++; read == 2500 {
+					cancel()
+				}
+			}}
+			_, err := Convert(ctx, strings.NewReader(input), &out, opts)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("err = %v, want context.Canceled", err)
+			}
+			if !json.Valid(out.Bytes()) {
+				t.Fatalf("output is not valid JSON:\n%s", out.String())
+			}
+		})
+	}
+}
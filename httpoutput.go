@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// httpBatchPoster is the output for --output-url. The converter writes
+// batches as JSON arrays, one per line; each complete line is sent as the
+// body of a POST request. Server errors and rate limiting are retried with
+// exponential backoff, and a batch that still fails is reported as a write
+// error, which aborts the conversion. Cancelling ctx abandons the request in
+// flight and any wait before a retry.
+type httpBatchPoster struct {
+	ctx         context.Context
+	client      *http.Client
+	url         string
+	contentType string
+	headers     http.Header
+	retries     int
+	backoff     time.Duration
+
+	pending []byte
+	batches int
+}
+
+func newHTTPBatchPoster(ctx context.Context, url, contentType string, headers http.Header, retries int) *httpBatchPoster {
+	return &httpBatchPoster{
+		ctx:         ctx,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		url:         url,
+		contentType: contentType,
+		headers:     headers,
+		retries:     retries,
+		backoff:     500 * time.Millisecond,
+	}
+}
+
+func (p *httpBatchPoster) Write(b []byte) (int, error) {
+	p.pending = append(p.pending, b...)
+	for {
+		end := bytes.IndexByte(p.pending, '\n')
+		if end < 0 {
+			return len(b), nil
+		}
+		p.batches++
+		if err := p.post(p.pending[:end]); err != nil {
+			return 0, fmt.Errorf("posting batch %d to %s: %w", p.batches, p.url, err)
+		}
+		p.pending = p.pending[end+1:]
+	}
+}
+
+// post sends one batch, retrying failures that may be temporary.
+func (p *httpBatchPoster) post(body []byte) error {
+	delay := p.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := p.send(body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt == p.retries {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-p.ctx.Done():
+			timer.Stop()
+			return p.ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// send makes a single request and reports whether a failure is worth
+// retrying.
+func (p *httpBatchPoster) send(body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range p.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", p.contentType)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		// A cancelled request is not worth retrying
+		return p.ctx.Err() == nil, err
+	}
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("server responded %s", resp.Status)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// schemaInferrer collects the types seen in each column for --infer-schema.
+// It is used as the converter's sink, so rows arrive one at a time from a
+// single goroutine.
+type schemaInferrer struct {
+	columns []string
+	seen    map[string]*columnTypes
+	rows    int
+}
+
+// columnTypes records which JSON types a column's values had, and in how many
+// rows the column appeared at all.
+type columnTypes struct {
+	types   map[string]bool
+	present int
+}
+
+func newSchemaInferrer() *schemaInferrer {
+	return &schemaInferrer{seen: make(map[string]*columnTypes)}
+}
+
+func (s *schemaInferrer) add(fields []string, row map[string]interface{}) error {
+	s.rows++
+	for _, key := range fields {
+		column, ok := s.seen[key]
+		if !ok {
+			// Columns keep the order they were first seen in
+			column = &columnTypes{types: make(map[string]bool)}
+			s.seen[key] = column
+			s.columns = append(s.columns, key)
+		}
+		value, ok := row[key]
+		if !ok {
+			continue
+		}
+		column.present++
+		column.types[jsonType(value)] = true
+	}
+	return nil
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case int64:
+		return "integer"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}, []string:
+		return "array"
+	default:
+		return "string"
+	}
+}
+
+// write writes a JSON Schema document describing the rows seen. A column
+// holding several types is widened: integers and numbers become a number,
+// and anything else mixed becomes a string. A column with a null value is
+// nullable, and one present in every row is required.
+func (s *schemaInferrer) write(w io.Writer) error {
+	// Built by hand so that properties stay in column order
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	buf.WriteString(`  "$schema": "https://json-schema.org/draft/2020-12/schema",` + "\n")
+	buf.WriteString(`  "type": "object",` + "\n")
+	buf.WriteString(`  "properties": {`)
+	required := []string{}
+	for i, key := range s.columns {
+		column := s.seen[key]
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		types, _ := json.Marshal(column.schemaType())
+		buf.WriteString("\n    ")
+		buf.Write(name)
+		buf.WriteString(`: {"type": `)
+		buf.Write(types)
+		buf.WriteString("}")
+		if column.present == s.rows {
+			required = append(required, key)
+		}
+	}
+	if len(s.columns) > 0 {
+		buf.WriteString("\n  ")
+	}
+	buf.WriteString("},\n")
+	names, _ := json.Marshal(required)
+	buf.WriteString(`  "required": `)
+	buf.Write(names)
+	buf.WriteString("\n}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// schemaType is the column's JSON Schema type: a single name, or a name and
+// "null" when the column is nullable.
+func (c *columnTypes) schemaType() interface{} {
+	var typ string
+	switch {
+	case len(c.types) == 0 || (len(c.types) == 1 && c.types["null"]):
+		return "null"
+	case c.only("integer"):
+		typ = "integer"
+	case c.only("integer", "number"):
+		typ = "number"
+	case c.only("boolean"):
+		typ = "boolean"
+	case c.only("object"):
+		typ = "object"
+	case c.only("array"):
+		typ = "array"
+	default:
+		typ = "string"
+	}
+	if c.types["null"] {
+		return []string{typ, "null"}
+	}
+	return typ
+}
+
+// only reports whether every non-null value had one of the given types.
+func (c *columnTypes) only(types ...string) bool {
+	for typ := range c.types {
+		if typ == "null" {
+			continue
+		}
+		allowed := false
+		for _, t := range types {
+			allowed = allowed || typ == t
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
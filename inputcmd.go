@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// commandInput reads a file through --input-cmd: the output of a shell
+// command run on it, such as a decryption tool. The command's stderr goes to
+// ours, so its own messages are shown as they are written.
+type commandInput struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	done   bool
+	err    error
+}
+
+// startInputCommand runs command with {file} replaced by filePath, quoted
+// for the shell, sending its messages to stderr.
+func startInputCommand(command, filePath string, stderr io.Writer) (*commandInput, error) {
+	line := strings.ReplaceAll(command, "{file}", shellQuote(filePath))
+	cmd := exec.Command("sh", "-c", line)
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting input command: %w", err)
+	}
+	return &commandInput{cmd: cmd, stdout: stdout}, nil
+}
+
+// Read reads the command's output. At the end of it, the command is waited
+// for, and a failure, such as a nonzero exit status, is returned in place of
+// io.EOF so that a truncated input isn't taken for a complete one.
+func (c *commandInput) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, c.endErr()
+	}
+	n, err := c.stdout.Read(p)
+	if errors.Is(err, io.EOF) {
+		c.done = true
+		c.err = c.cmd.Wait()
+		return n, c.endErr()
+	}
+	return n, err
+}
+
+func (c *commandInput) endErr() error {
+	if c.err != nil {
+		return fmt.Errorf("input command: %w", c.err)
+	}
+	return io.EOF
+}
+
+// Close stops the command if its output wasn't read to the end, as when the
+// conversion is cancelled.
+func (c *commandInput) Close() error {
+	if c.done {
+		return nil
+	}
+	c.done = true
+	c.cmd.Process.Kill()
+	c.err = c.cmd.Wait()
+	return nil
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -1,182 +1,2239 @@
 package main
 
 import (
-	"bufio"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"go-worker/converter"
 
 	"github.com/schollz/progressbar/v3"
+	"gopkg.in/yaml.v3"
 )
 
-type Task struct {
-	Row  map[string]interface{}
-	Line int
+// stringList is a flag.Value collecting every occurrence of a repeatable
+// flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
 }
 
-func readAndParseCSV(filePath string, tasks chan<- Task, estimatedTotalLines int, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
-	file, err := os.Open(filePath)
-	if err != nil {
-		fmt.Println("Error opening file:", err)
-		close(tasks)
-		return
-	}
-	defer file.Close()
+// targets holds the flag defaults for each --target preset. Both loaders
+// take one JSON object per line; empty cells become null rather than "" so
+// they load into typed columns and fields.
+var targets = map[string]map[string]string{
+	// BigQuery column names may only hold letters, digits and underscores
+	"bigquery": {
+		"format":      converter.FormatJSONL,
+		"key-case":    converter.KeyCaseSnake,
+		"null-values": ",",
+		"infer-types": "true",
+	},
+	// The bulk API expects an action line before every document
+	"elasticsearch": {
+		"format":      converter.FormatJSONL,
+		"action-line": `{"index":{}}`,
+		"null-values": ",",
+		"infer-types": "true",
+	},
+}
 
-	reader := csv.NewReader(file)
+// applyTarget sets the defaults of the named --target preset for each flag
+// not given on the command line or in the config file.
+func applyTarget(flags *flag.FlagSet, name string) error {
+	defaults, ok := targets[name]
+	if !ok {
+		return fmt.Errorf("must be bigquery or elasticsearch, got %q", name)
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for flagName, value := range defaults {
+		if set[flagName] {
+			continue
+		}
+		if err := flags.Set(flagName, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	headers, err := reader.Read()
+// applyConfig sets every flag named in the config file at path that wasn't
+// given on the command line. Lists become comma-separated values, or repeat
+// a repeatable flag such as file, and maps become key:value pairs as taken
+// by --rename.
+func applyConfig(flags *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Println("Error reading CSV headers:", err)
-		close(tasks)
-		return
+		return err
+	}
+	// YAML is a superset of JSON, so one parser reads both
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
 	}
 
-	bar := progressbar.Default(int64(estimatedTotalLines))
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
 
-	lineNumber := 0
-	for {
-		record, err := reader.Read()
-		lineNumber++
-		if err != nil {
-			if err.Error() == "EOF" {
-				break
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := flags.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s: unknown option %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		_, repeatable := f.Value.(*stringList)
+		for _, value := range configValues(config[name], repeatable) {
+			// Set records the flag as given, for Visit
+			if err := flags.Set(name, value); err != nil {
+				return fmt.Errorf("%s: option %q: %w", path, name, err)
 			}
-			fmt.Println("Error reading CSV record:", err)
-			break
 		}
+	}
+	return nil
+}
 
-		row := make(map[string]interface{})
-		for i, value := range record {
-			key := strings.ToLower(headers[i])
-			row[key] = value
+// configValues converts a config file value to the flag values it stands
+// for: one per item for a repeatable flag, otherwise a single value.
+func configValues(value interface{}, repeatable bool) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		if repeatable {
+			return items
 		}
+		return []string{strings.Join(items, ",")}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			pairs[i] = fmt.Sprintf("%s:%v", key, v[key])
+		}
+		return []string{strings.Join(pairs, ",")}
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// splitList splits a comma-separated flag value into trimmed names. An empty
+// value yields nil.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	return names
+}
 
-		// Send the parsed row to the tasks channel
-		tasks <- Task{Row: row, Line: lineNumber}
+// parseColumnRange parses the --column-range value, a comma-separated list
+// of column positions and ranges of them, such as 2-5,8, counting from 1.
+func parseColumnRange(value string) ([]int, error) {
+	var positions []int
+	for _, part := range splitList(value) {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil || first < 1 {
+			return nil, fmt.Errorf("%q: positions count from 1", part)
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(strings.TrimSpace(to))
+			if err != nil || last < first {
+				return nil, fmt.Errorf("%q: expected a range like 2-5", part)
+			}
+		}
+		for n := first; n <= last; n++ {
+			positions = append(positions, n)
+		}
+	}
+	return positions, nil
+}
 
-		bar.Add(1)
+// parseRename parses the --rename value, a comma-separated list of old:new
+// pairs.
+func parseRename(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	rename := make(map[string]string)
+	for _, pair := range splitList(value) {
+		from, to, ok := strings.Cut(pair, ":")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("expected old:new, got %q", pair)
+		}
+		rename[from] = to
 	}
+	return rename, nil
+}
 
-	close(tasks)
-	bar.Finish()
+// parseHeaders parses the --output-header values, each a Name: value pair.
+func parseHeaders(values []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, value := range values {
+		name, headerValue, ok := strings.Cut(value, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected Name: value, got %q", value)
+		}
+		headers.Add(name, strings.TrimSpace(headerValue))
+	}
+	return headers, nil
 }
 
-func worker(_ int, tasks <-chan Task, _ string, wg *sync.WaitGroup, result *sync.Mutex, encoder *json.Encoder) {
-	defer wg.Done()
+// parseDateColumns parses the --date-columns values, each a column:layout
+// pair. Only the first colon separates the two, since layouts such as
+// 15:04 contain colons of their own.
+func parseDateColumns(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	layouts := make(map[string]string, len(values))
+	for _, value := range values {
+		column, layout, ok := strings.Cut(value, ":")
+		if !ok || column == "" || layout == "" {
+			return nil, fmt.Errorf("expected column:layout, got %q", value)
+		}
+		layouts[column] = layout
+	}
+	return layouts, nil
+}
 
-	for task := range tasks {
-		// Acquire the result mutex before writing to the JSON file
-		result.Lock()
+// parseArrayColumns parses the --array-columns values, each a column:sep
+// pair. Only the first colon separates the two, so "tags::" splits on
+// colons.
+func parseArrayColumns(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	separators := make(map[string]string, len(values))
+	for _, value := range values {
+		column, sep, ok := strings.Cut(value, ":")
+		if !ok || column == "" || sep == "" {
+			return nil, fmt.Errorf("expected column:separator, got %q", value)
+		}
+		separators[column] = sep
+	}
+	return separators, nil
+}
 
-		if err := encoder.Encode(task.Row); err != nil {
-			fmt.Printf("Error writing JSON on line %d: %v\n", task.Line, err)
-			result.Unlock()
-			return
+// parseAddFields parses the --add-field values, each a key=value pair. The
+// value may be empty.
+func parseAddFields(values []string) ([]converter.Field, error) {
+	fields := make([]converter.Field, 0, len(values))
+	for _, value := range values {
+		key, fieldValue, ok := strings.Cut(value, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", value)
 		}
+		fields = append(fields, converter.Field{Key: key, Value: fieldValue})
+	}
+	return fields, nil
+}
 
-		// Release the mutex
-		result.Unlock()
+// parseDelimiter turns the --delimiter argument into the rune used as the CSV
+// field separator, and --comment-char into the comment marker. It accepts a
+// single character or the literal "tab".
+func parseDelimiter(value string) (rune, error) {
+	if value == "tab" {
+		return '\t', nil
+	}
+	if utf8.RuneCountInString(value) != 1 {
+		return 0, fmt.Errorf("must be a single character or \"tab\", got %q", value)
+	}
+	r, _ := utf8.DecodeRuneInString(value)
+	if r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return 0, fmt.Errorf("%q is not allowed", value)
 	}
+	return r, nil
 }
 
 func main() {
-	args := os.Args
-	fileIndex := -1
-	outputIndex := -1
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run converts as the command line args ask, reading stdin for the input
+// "-" and writing rows, when no --output is given, to stdout and everything
+// else to stderr. It returns the exit status: 0 on success, 1 when the
+// conversion fails and 2 for invalid flags.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags, f := newFlags(stderr)
+	if err := parseFlags(flags, f, args); err != nil {
+		var flagErr *flagError
+		switch {
+		case errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.As(err, &flagErr):
+			// The flag package reports its own parse errors
+			fmt.Fprintln(stderr, err)
+		}
+		return 2
+	}
+	opts, code, err := buildOptions(f, stdin)
+	if err != nil {
+		if code == 2 {
+			fmt.Fprintln(stderr, err)
+		} else {
+			fmt.Fprintln(stderr, "Error:", err)
+		}
+		return code
+	}
+
+	// Status lines, like the progress bar, go to stderr so they never mix
+	// with the data. Errors always go to stderr, even with --quiet.
+	var status io.Writer = stderr
+	if f.quiet {
+		status = io.Discard
+	}
+	debug := io.Discard
+	if f.verbose && !f.quiet {
+		debug = status
+	}
 
-	for i, arg := range args {
-		if arg == "--file" && i+1 < len(args) {
-			fileIndex = i + 1
-		} else if arg == "--output" && i+1 < len(args) {
-			outputIndex = i + 1
+	// With --log-format json, events are logged as JSON lines in place of
+	// the status lines and progress bar
+	var logger *slog.Logger
+	if f.logFormat == "json" {
+		level := slog.LevelInfo
+		if f.quiet {
+			level = slog.LevelError
 		}
+		logger = slog.New(slog.NewJSONHandler(stderr, &slog.HandlerOptions{Level: level}))
+		status, debug = io.Discard, io.Discard
 	}
 
-	if fileIndex != -1 {
-		filePath := args[fileIndex]
-		outputPath := ""
-		if outputIndex != -1 {
-			outputPath = args[outputIndex]
+	startTime := time.Now()
+
+	fmt.Fprintln(status, "Reading file...")
+	fmt.Fprintln(status, "=================")
+
+	// Files are opened one at a time as the converter reaches them. The
+	// progress bar counts the bytes read from each file (before any
+	// decompression) against their total size; stdin's size is unknown, so
+	// its bar runs as a spinner.
+	var progress progressReporter
+	sources := make([]converter.Source, len(f.paths))
+	var totalBytes int64
+	for i, filePath := range f.paths {
+		filePath := filePath
+		// A command's output is only known to be gzip when told so
+		gzipped := f.gzipIn || (f.inputCmd == "" && strings.HasSuffix(filePath, ".gz"))
+		sources[i] = converter.Source{
+			Name: filePath,
+			Open: func() (io.ReadCloser, error) {
+				return openInput(filePath, f.inputCmd, gzipped, stdin, stderr, progress)
+			},
+		}
+		if filePath == "-" {
+			sources[i].Name = "stdin"
+			totalBytes = -1
+			continue
+		}
+
+		info, err := os.Stat(filePath)
+		if err != nil {
+			logError(stderr, logger, "Error", err)
+			return 1
 		}
+		if totalBytes >= 0 {
+			totalBytes += info.Size()
+		}
+	}
+	if totalBytes >= 0 {
+		fmt.Fprintf(status, "Total input size: %d bytes\n", totalBytes)
+	}
+	// A command's output may be any size, so its bar runs as a spinner too
+	progressTotal := totalBytes
+	if f.inputCmd != "" {
+		progressTotal = -1
+	}
+	workersChosen := f.workerCount == 0
+	if workersChosen {
+		f.workerCount = autoWorkers(totalBytes)
+	}
+	opts.Workers = f.workerCount
 
-		startTime := time.Now()
+	// Ctrl-C or SIGTERM cancels the conversion, including an output's
+	// requests in flight; a second signal kills the process as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
 
-		fmt.Println("Reading file...")
-		fmt.Println("=================")
+	// Create a JSON file, or stream to stdout. With --split-lines the
+	// output is the first of several numbered parts. Files are written
+	// under a temporary name and only moved into place once the whole
+	// conversion has succeeded.
+	// A dry run parses and encodes every row, then discards it.
+	var output *outputWriter
+	var table *sqliteTable
+	switch {
+	case f.dryRun || f.outputPaths != nil:
+		// With a template, convertEach creates each output in turn
+		output = &outputWriter{Writer: io.Discard}
+	case f.sqlitePath != "":
+		output = &outputWriter{Writer: io.Discard}
+		table, err = openSQLiteTable(f.sqlitePath, f.sqliteTableName)
+		if err != nil {
+			logError(stderr, logger, "Error opening SQLite database", err)
+			return 1
+		}
+	case f.partitionBy != "":
+		// --output names the directory of the partitions, opened as their
+		// values turn up
+		output = &outputWriter{Writer: io.Discard}
+		if err := makeOutputDir(f.outputPath, f.makeDirs); err != nil {
+			logError(stderr, logger, "Error creating JSON file", err)
+			return 1
+		}
+	case f.outputURL != "":
+		output = &outputWriter{Writer: newHTTPBatchPoster(ctx, f.outputURL, f.outputContentType, f.outputHeaders, f.outputRetries)}
+	default:
+		firstPath := f.outputPath
+		if f.splitLines > 0 {
+			firstPath = partPath(f.outputPath, 0)
+		}
+		if firstPath == "" {
+			output = newOutputWriter(stdout, f.gzipOut)
+			break
+		}
+		output, err = createOutput(firstPath, f.gzipOut, f.appendOutput, f.makeDirs)
+		if err != nil {
+			logError(stderr, logger, "Error creating JSON file", err)
+			return 1
+		}
+	}
+	outputs := []*outputWriter{output}
 
-		estimatedTotalLines, err := evaluateTotalLines(filePath)
+	var rejects *rejectWriter
+	if f.rejectsPath != "" {
+		file, err := os.Create(f.rejectsPath)
 		if err != nil {
-			fmt.Println("Error evaluating total lines:", err)
+			logError(stderr, logger, "Error creating rejects file", err)
+			output.discard()
+			if table != nil {
+				table.discard()
+			}
+			return 1
+		}
+		defer file.Close()
+		rejects = newRejectWriter(file)
+	}
+
+	// The bar is only drawn alongside text status lines
+	switch {
+	case f.quiet || f.progressMode == "none" || (f.progressMode == "bar" && logger != nil):
+		progress = silentProgress{}
+	case f.progressMode == "json":
+		progress = newJSONProgress(stderr, progressTotal, time.Second)
+	default:
+		progress = newBarProgress(stderr, progressTotal, 500*time.Millisecond)
+	}
+
+	opts.DelimiterDetected = func(source string, delimiter rune) {
+		fmt.Fprintf(debug, "Detected delimiter: %q in %s\n", delimiter, source)
+	}
+	opts.Warn = func(source string, line int, msg string) {
+		if logger != nil {
+			logger.Warn(msg, "source", source, "line", line)
+			return
+		}
+		if line == 0 {
+			fmt.Fprintf(status, "Warning: %s: %s\n", source, msg)
 			return
 		}
+		fmt.Fprintf(status, "Warning: %s row %d: %s\n", source, line, msg)
+	}
+	opts.Progress = progress.Row
+	if rejects != nil {
+		opts.Reject = rejects.write
+	}
+	var inferrer *schemaInferrer
+	var parquetOut *parquetFile
+	switch {
+	case table != nil:
+		opts.Sink = table.insert
+		opts.Header = table.setHeader
+	case f.inferSchema:
+		inferrer = newSchemaInferrer()
+		opts.Sink = inferrer.add
+	case f.format == formatParquet:
+		parquetOut = newParquetFile(output)
+		opts.Sink = parquetOut.add
+		opts.Header = parquetOut.setHeader
+		// The converter's own formats go unused with a sink
+		opts.Format = converter.FormatJSONL
+	}
+	if f.withTrailer {
+		opts.Trailer = newTrailer(sourceNames(sources))
+	}
+	var partitions []*outputWriter
+	if f.partitionBy != "" {
+		opts.PartitionBy = f.partitionBy
+		files := &partitionFiles{max: f.maxPartitions}
+		opts.OpenPartition = func(value string) (io.Writer, error) {
+			if f.dryRun {
+				return io.Discard, nil
+			}
+			path := filepath.Join(f.outputPath, partitionFileName(f.partitionBy, value)+formatExtension(f.format, f.gzipOut))
+			next, err := files.create(path, f.gzipOut, f.appendOutput)
+			if err != nil {
+				return nil, err
+			}
+			partitions = append(partitions, next.outputWriter)
+			return next, nil
+		}
+	}
+	if f.splitLines > 0 && !f.dryRun {
+		opts.SplitRows = f.splitLines
+		opts.NextPart = func(part int) (io.Writer, error) {
+			if err := output.Close(); err != nil {
+				return nil, err
+			}
+			path := partPath(f.outputPath, part)
+			next, err := createOutput(path, f.gzipOut, f.appendOutput, f.makeDirs)
+			if err != nil {
+				return nil, err
+			}
+			output = next
+			outputs = append(outputs, next)
+			return next, nil
+		}
+	}
+	if workersChosen {
+		fmt.Fprintf(debug, "Workers: %d (chosen from the input size)\n", f.workerCount)
+	} else {
+		fmt.Fprintf(debug, "Workers: %d\n", f.workerCount)
+	}
+	fmt.Fprintf(debug, "Format: %s\n", f.format)
+	if opts.DetectDelimiter {
+		fmt.Fprintln(debug, "Delimiter: auto")
+	} else {
+		fmt.Fprintf(debug, "Delimiter: %q\n", opts.Delimiter)
+	}
+	fmt.Fprintf(debug, "Key case: %s\n", f.keyCase)
 
-		fmt.Printf("Estimated total lines: %d\n", estimatedTotalLines)
+	if logger != nil {
+		logger.Info("conversion started", "files", sourceNames(sources), "workers", f.workerCount, "format", f.format)
+	}
 
-		tasks := make(chan Task)
+	var stats converter.Stats
+	var converted []convertedFile
+	if f.outputPaths != nil && !f.dryRun {
+		converted, stats, err = convertEach(ctx, sources, f.outputPaths, f.gzipOut, f.makeDirs, f.keepPartial, opts)
+	} else {
+		stats, err = converter.ConvertSources(ctx, sources, output, opts)
+	}
+	progress.Finish()
+	// Like any failure, an empty result then leaves no output file behind
+	if f.failOnEmpty && err == nil && stats.Written == 0 {
+		err = errors.New("no rows were written (--fail-on-empty)")
+	}
+	if inferrer != nil && err == nil {
+		err = inferrer.write(output)
+	}
+	if parquetOut != nil && err == nil {
+		err = parquetOut.close()
+	}
+	// Closing writes the gzip trailer, so it must succeed before we report
+	// success
+	if closeErr := output.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	for _, partition := range partitions {
+		if closeErr := partition.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	outputs = append(outputs, partitions...)
+	// All or nothing: a failed or interrupted run leaves no partial file
+	// that could pass for a complete one, unless --keep-partial asks for
+	// what was written before an interruption. The framing and any gzip
+	// trailer were written either way, so such a file is still valid.
+	keep := err == nil || (f.keepPartial && interrupted(err))
+	for _, part := range outputs {
+		if keep {
+			if commitErr := part.commit(); commitErr != nil {
+				err, keep = commitErr, false
+			}
+		}
+		if !keep {
+			part.discard()
+		}
+	}
+	if table != nil {
+		if !keep {
+			table.discard()
+		} else if commitErr := table.commit(); commitErr != nil {
+			err = commitErr
+		}
+	}
+	var rejectsErr error
+	if rejects != nil {
+		if rejectsErr = rejects.flush(); rejectsErr != nil {
+			logError(stderr, logger, "Error writing rejects file", rejectsErr)
+		}
+	}
+	processTime := time.Since(startTime).Seconds()
+
+	result := "complete"
+	switch {
+	case errors.Is(err, context.Canceled):
+		result = "interrupted"
+	case errors.Is(err, context.DeadlineExceeded):
+		result = "timed out"
+	case err != nil:
+		result = "failed"
+	}
+	if logger != nil {
+		if f.partitionBy != "" && !f.dryRun && err == nil {
+			logger.Info("partitions written", "count", len(partitions), "dir", f.outputPath)
+		}
+		for _, file := range converted {
+			logger.Info("file written", "file", file.Source, "output", file.Path, "rows_read", file.Stats.Read, "rows_written", file.Stats.Written)
+		}
+		logSummary(logger, sources, result, err, stats, processTime)
+	} else {
+		switch result {
+		case "interrupted", "timed out":
+			outcome := "interrupted"
+			if result == "timed out" {
+				outcome = fmt.Sprintf("timed out after %s", f.timeout)
+			}
+			switch {
+			case f.outputPaths != nil && f.keepPartial:
+				fmt.Fprintf(stderr, "Conversion %s; the last file written holds only the rows converted so far.\n", outcome)
+			case f.outputPaths != nil:
+				fmt.Fprintf(stderr, "Conversion %s; only the files converted in full were written.\n", outcome)
+			case (f.outputPath == "" && f.sqlitePath == "") || f.keepPartial:
+				fmt.Fprintf(stderr, "Conversion %s; output holds the rows written so far.\n", outcome)
+			case f.appendOutput:
+				fmt.Fprintf(stderr, "Conversion %s; nothing was appended to the output file.\n", outcome)
+			default:
+				fmt.Fprintf(stderr, "Conversion %s; no output file was written.\n", outcome)
+			}
+		case "failed":
+			fmt.Fprintln(stderr, "Error converting CSV:", err)
+		default:
+			fmt.Fprintln(status, "Conversion complete!")
+			if f.partitionBy != "" && !f.dryRun {
+				fmt.Fprintf(status, "Wrote %d partitions to %s\n", len(partitions), f.outputPath)
+			}
+		}
+		if f.dryRun {
+			fmt.Fprintln(status, "Dry run: no output was written.")
+		}
+		// Each file written in full, or in part with --keep-partial
+		for _, file := range converted {
+			fmt.Fprintf(status, "Wrote %d of %d rows from %s to %s\n", file.Stats.Written, file.Stats.Read, file.Source, file.Path)
+		}
+		printSummary(status, sources, result, stats, processTime)
+	}
+
+	// A failed, interrupted or timed out conversion must not look successful
+	// to scripts, whether or not --strict was given
+	if err != nil || rejectsErr != nil {
+		return 1
+	}
+	return 0
+}
+
+// flagValues holds the command line flags, and what parseFlags and
+// buildOptions derive from them.
+type flagValues struct {
+	filePaths           stringList
+	recursive           bool
+	outputTemplate      string
+	outputDir           string
+	outputPath          string
+	partitionBy         string
+	maxPartitions       int
+	makeDirs            bool
+	keepPartial         bool
+	outputURL           string
+	outputContentType   string
+	outputHeaderArgs    stringList
+	inferSchema         bool
+	sqlitePath          string
+	sqliteTableName     string
+	outputRetries       int
+	dryRun              bool
+	appendOutput        bool
+	workerCount         int
+	queueSize           int
+	timeout             time.Duration
+	rateLimit           float64
+	format              string
+	pretty              bool
+	preserveFieldOrder  bool
+	indent              string
+	splitLines          int
+	actionLine          string
+	target              string
+	batchSize           int
+	failOnEmpty         bool
+	withTrailer         bool
+	yamlSequence        bool
+	delimiterArg        string
+	widthsArg           string
+	commentChar         string
+	splitRegexArg       string
+	maxFieldSize        int
+	lazyQuotes          bool
+	trimLeadingSpace    bool
+	inputEncoding       string
+	limit               int
+	skipRows            int
+	headersArg          string
+	columnsFile         string
+	selectArg           string
+	columnRange         string
+	excludeArg          string
+	renameArg           string
+	keyCase             string
+	valueCase           string
+	overflowKey         string
+	withLineNumber      bool
+	lineKey             string
+	addHash             bool
+	hashKey             string
+	addFieldArgs        stringList
+	sourceKey           string
+	nest                bool
+	nestSeparator       string
+	ordered             bool
+	concurrentFiles     bool
+	trim                bool
+	nullValuesArg       string
+	nullCaseInsensitive bool
+	omitEmpty           bool
+	stringColumnsArg    string
+	inferTypes          bool
+	gzipIn              bool
+	inputCmd            string
+	gzipOut             bool
+	noHeader            bool
+	dateColumnArgs      stringList
+	sample              float64
+	seed                int64
+	dedupOn             string
+	transformArgs       stringList
+	whereArgs           stringList
+	arrayColumnArgs     stringList
+	emptyArrayNull      bool
+	skipInvalidDates    bool
+	rejectsPath         string
+	requireColumns      string
+	strictColumns       bool
+	schemaPath          string
+	strict              bool
+	progressMode        string
+	quiet               bool
+	logFormat           string
+	verbose             bool
+	configPath          string
+
+	// Whether --source-field and --workers were given
+	sourceKeySet bool
+	workersSet   bool
+
+	// The input files, with any globs expanded; the output for each, with
+	// --output-template or --output-dir; and the --output-header headers
+	paths         []string
+	outputPaths   []string
+	outputHeaders http.Header
+}
+
+// newFlags declares the command line flags, reporting parse errors and usage
+// to stderr.
+func newFlags(stderr io.Writer) (*flag.FlagSet, *flagValues) {
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	f := &flagValues{}
+	flags.Var(&f.filePaths, "file", "CSV `path` to convert, or - for stdin; repeat or use a glob, with ** matching any number of directories, to convert several files (default stdin)")
+	flags.BoolVar(&f.recursive, "recursive", false, "convert every .csv and .csv.gz file under a --file directory")
+	flags.StringVar(&f.outputTemplate, "output-template", "", "write each input to its own file, named by this `template` with {dir} and {name} replaced by the input's directory and name without extension, e.g. {dir}/{name}.json")
+	flags.StringVar(&f.outputDir, "output-dir", "", "write each input to its own file in this `directory`, named after the input with the format's extension, e.g. a.csv to a.json")
+	flags.StringVar(&f.outputPath, "output", "", "JSON `path` to write (default stdout)")
+	flags.StringVar(&f.partitionBy, "partition-by", "", "write each row to a file in the --output directory named after its value of this `column`, such as region=US.jsonl")
+	flags.IntVar(&f.maxPartitions, "max-partitions", 100, "keep at most `N` --partition-by files open, closing the least recently written to reopen it when needed")
+	flags.BoolVar(&f.makeDirs, "mkdir", false, "create the output file's missing parent directories")
+	flags.BoolVar(&f.keepPartial, "keep-partial", false, "when interrupted or timed out, keep the rows written so far as a valid, shorter output instead of removing it")
+	flags.StringVar(&f.outputURL, "output-url", "", "POST the rows to this `URL` in batches of --batch-size (default 100), each a JSON array, instead of writing a file")
+	flags.StringVar(&f.outputContentType, "output-content-type", "application/json", "Content-Type `value` of --output-url requests")
+	flags.Var(&f.outputHeaderArgs, "output-header", "extra `Name: value` header for --output-url requests (repeatable)")
+	flags.BoolVar(&f.inferSchema, "infer-schema", false, "write a JSON Schema describing the columns' inferred types instead of the rows; use --limit to sample")
+	flags.StringVar(&f.sqlitePath, "sqlite", "", "insert the rows into a table of this SQLite database `file` instead of writing a file")
+	flags.StringVar(&f.sqliteTableName, "table", "", "`name` of the --sqlite table, created from the header if it doesn't exist")
+	flags.IntVar(&f.outputRetries, "output-retries", 3, "times to retry an --output-url batch after a 5xx or 429 response or a network error")
+	flags.BoolVar(&f.dryRun, "dry-run", false, "read, validate and encode every row but write no output")
+	flags.BoolVar(&f.appendOutput, "append", false, "with --format jsonl, append to the output file instead of replacing it; the rows are staged and only added once the conversion succeeds")
+	flags.IntVar(&f.workerCount, "workers", 0, "number of worker goroutines, at least 1 (default one per 4 MiB of input, up to the number of CPUs)")
+	flags.IntVar(&f.queueSize, "queue-size", 0, "rows that can wait between reader, workers and writer (default 4 per worker)")
+	flags.DurationVar(&f.timeout, "timeout", 0, "abort the conversion if it runs longer than this `duration`, such as 30s or 5m (0 for no limit)")
+	flags.Float64Var(&f.rateLimit, "rate", 0, "process at most `N` rows per second across all workers (0 for no limit)")
+	flags.StringVar(&f.format, "format", converter.FormatJSONL, "output format: jsonl, json-array, pretty-array, csv, yaml or parquet. Parquet column types come from the first 1000 rows, and a later value that doesn't fit fails the conversion; list such columns in --string-columns")
+	flags.BoolVar(&f.pretty, "pretty", false, "indent jsonl and json-array rows for reading instead of writing them compactly")
+	flags.BoolVar(&f.preserveFieldOrder, "preserve-field-order", false, "write JSON keys in the CSV header's order instead of sorted")
+	flags.StringVar(&f.indent, "indent", "  ", "`string` of spaces indenting each level with --pretty, or \"tab\"")
+	flags.IntVar(&f.splitLines, "split-lines", 0, "start a new numbered output file (out.0.json, out.1.json, ...) every `N` rows")
+	flags.StringVar(&f.actionLine, "action-line", "", "with --format jsonl, write this JSON `line` before every row, e.g. {\"index\":{}} for Elasticsearch")
+	flags.StringVar(&f.target, "target", "", "preset for a bulk loader, `name` bigquery or elasticsearch; sets defaults for flags not given")
+	flags.IntVar(&f.batchSize, "batch-size", 0, "with --format jsonl, write rows as JSON arrays of up to `N` rows, one per line")
+	flags.BoolVar(&f.failOnEmpty, "fail-on-empty", false, "fail, with no output, when no rows are written, such as for a header-only input")
+	flags.BoolVar(&f.withTrailer, "with-trailer", false, "after the rows, write a final _meta object with the row counts, input files and duration of a successful conversion")
+	flags.BoolVar(&f.yamlSequence, "yaml-sequence", false, "with --format yaml, write one list instead of a document per row")
+	flags.StringVar(&f.delimiterArg, "delimiter", ",", "field separator: a single character, \"tab\", or \"auto\" to detect comma, tab, semicolon or pipe from each file's header")
+	flags.StringVar(&f.widthsArg, "widths", "", "read fixed-width input, cutting each line into fields of these comma-separated `widths` in characters")
+	flags.StringVar(&f.commentChar, "comment-char", "", "skip lines starting with this `character`, such as #")
+	flags.StringVar(&f.splitRegexArg, "split-regex", "", "split each line on this regular `expression` instead of parsing CSV, e.g. '\\|\\|'; quoting isn't recognized")
+	flags.IntVar(&f.maxFieldSize, "max-field-size", 0, "skip rows with a field over `N` bytes, and abort on a record far larger than its columns allow (0 for no limit)")
+	flags.BoolVar(&f.lazyQuotes, "lazy-quotes", false, "tolerate stray quotes inside fields")
+	flags.BoolVar(&f.trimLeadingSpace, "trim-leading-space", false, "ignore whitespace after each delimiter")
+	flags.StringVar(&f.inputEncoding, "encoding", "UTF-8", "character set of the input, e.g. ISO-8859-1 or windows-1252")
+	flags.IntVar(&f.limit, "limit", 0, "convert only the first `N` data rows of each file (0 for all)")
+	flags.IntVar(&f.skipRows, "skip-rows", 0, "discard `N` leading records before the header")
+	flags.StringVar(&f.headersArg, "headers", "", "comma-separated column `names` to use instead of the header row")
+	flags.StringVar(&f.columnsFile, "columns-file", "", "read the column names from this `file`, one per line or as a single header line, and treat the input as data only (implies --no-header)")
+	flags.StringVar(&f.selectArg, "select", "", "comma-separated `columns` to keep in each row")
+	flags.StringVar(&f.columnRange, "column-range", "", "comma-separated column `positions` to keep, counting from 1, such as 2-5 or 1,3,7; combined with --select, a column named by either is kept")
+	flags.StringVar(&f.excludeArg, "exclude", "", "comma-separated `columns` to drop from each row (applied after --select)")
+	flags.StringVar(&f.renameArg, "rename", "", "comma-separated `old:new` pairs renaming columns")
+	flags.StringVar(&f.keyCase, "key-case", converter.KeyCaseLower, "header key casing: original, lower, upper or snake")
+	flags.StringVar(&f.valueCase, "value-case", "", "change the case of string values: lower or upper")
+	flags.StringVar(&f.overflowKey, "overflow-key", "", "collect fields beyond the header's width under this `key`")
+	flags.BoolVar(&f.withLineNumber, "with-line-number", false, "add each row's line number to the output")
+	flags.StringVar(&f.lineKey, "line-field", "_line", "`key` for --with-line-number")
+	flags.BoolVar(&f.addHash, "add-hash", false, "add a SHA-256 hash of each row's content, for spotting rows already ingested")
+	flags.StringVar(&f.hashKey, "hash-field", "_hash", "`key` for --add-hash")
+	flags.Var(&f.addFieldArgs, "add-field", "add `key=value` to every row; the value __line__ or __source__ is replaced by the row's line number or file name (repeatable)")
+	flags.StringVar(&f.sourceKey, "source-field", "", "`key` recording each row's input file (default _source with several files)")
+	flags.BoolVar(&f.nest, "nest", false, "build nested objects from keys containing the nest separator")
+	flags.StringVar(&f.nestSeparator, "nest-separator", ".", "`separator` splitting keys into nested objects with --nest")
+	flags.BoolVar(&f.ordered, "ordered", false, "write rows in input order")
+	flags.BoolVar(&f.concurrentFiles, "concurrent-files", false, "read several --file inputs at once, up to one per worker, merging their rows into one output")
+	flags.BoolVar(&f.trim, "trim", false, "trim surrounding whitespace from header names and values")
+	flags.StringVar(&f.nullValuesArg, "null-values", "", "comma-separated `values` written as JSON null; include an empty entry (e.g. \",NA\") for empty cells")
+	flags.BoolVar(&f.nullCaseInsensitive, "null-ignore-case", false, "match --null-values regardless of case")
+	flags.BoolVar(&f.omitEmpty, "omit-empty", false, "leave the keys of empty cells out of their objects instead of writing \"\"")
+	flags.StringVar(&f.stringColumnsArg, "string-columns", "", "comma-separated `columns` kept as strings by --infer-types, such as ZIP codes or IDs")
+	flags.BoolVar(&f.inferTypes, "infer-types", false, "emit numbers and booleans as JSON scalars instead of strings")
+	flags.BoolVar(&f.gzipIn, "gzip-in", false, "decompress gzip input (implied by a .gz file name)")
+	flags.StringVar(&f.inputCmd, "input-cmd", "", "read each file from the output of this shell `command`, with {file} replaced by the file's path, e.g. 'gpg -d {file}'")
+	flags.BoolVar(&f.gzipOut, "gzip-out", false, "gzip the output (implied by a .gz output name)")
+	flags.BoolVar(&f.noHeader, "no-header", false, "treat the first record as data")
+	flags.Var(&f.dateColumnArgs, "date-columns", "rewrite a column's dates as RFC 3339, given as `column:layout` with a Go time layout such as 02/01/2006 (repeatable)")
+	flags.Float64Var(&f.sample, "sample", 1, "keep a random `fraction` of rows, e.g. 0.01 for about 1%")
+	flags.Int64Var(&f.seed, "seed", 0, "seed for --sample, giving the same sample on every run (default random)")
+	flags.StringVar(&f.dedupOn, "dedup-on", "", "comma-separated `columns` identifying a row; later rows repeating their values are dropped")
+	flags.Var(&f.transformArgs, "transform", "rewrite a column's values with functions separated by |, e.g. `name:trim|upper`; functions are upper, lower, trim, replace(old, new) and substr(start, length) (repeatable)")
+	flags.Var(&f.whereArgs, "where", "keep only rows matching a condition such as `status == \"active\"`: a column, one of ==, !=, <, <=, >, >= or contains, and a value (repeatable; all must match)")
+	flags.Var(&f.arrayColumnArgs, "array-columns", "split a column's cells into a JSON array, given as `column:separator` such as tags:; (repeatable)")
+	flags.BoolVar(&f.emptyArrayNull, "empty-array-null", false, "write empty --array-columns cells as null instead of []")
+	flags.BoolVar(&f.skipInvalidDates, "skip-invalid-dates", false, "leave out rows whose --date-columns cells don't match the layout instead of keeping the value")
+	flags.StringVar(&f.rejectsPath, "rejects", "", "CSV `file` collecting skipped malformed and invalid rows with their line number and reason")
+	flags.StringVar(&f.requireColumns, "require-columns", "", "comma-separated `columns` every input's header must have; an input missing any fails before its rows are read")
+	flags.BoolVar(&f.strictColumns, "strict-columns", false, "also fail an input whose header has columns --require-columns doesn't list")
+	flags.StringVar(&f.schemaPath, "schema", "", "JSON `file` listing required columns and their types; failing rows are skipped, or abort with --strict")
+	flags.BoolVar(&f.strict, "strict", false, "abort on the first malformed row and remove the partial output")
+	flags.StringVar(&f.progressMode, "progress", "bar", "progress reporting on stderr: bar, json (a {\"processed\":N,\"total\":M,\"rows\":R} line every second) or none")
+	flags.BoolVar(&f.quiet, "quiet", false, "suppress the progress bar, status lines and warnings")
+	flags.StringVar(&f.logFormat, "log-format", "text", "status, warning and error output: text, or json for structured log lines")
+	flags.BoolVar(&f.verbose, "verbose", false, "also print the settings in effect")
+	flags.StringVar(&f.configPath, "config", "", "YAML or JSON `file` of option values, keyed by flag name; flags given on the command line take precedence")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [options] --file <csv file> --output <json file>\n\nOptions:\n", flags.Name())
+		flags.PrintDefaults()
+	}
+	return flags, f
+}
+
+// parseFlags parses args into f, then applies any --config file and
+// --target preset. An error from the flag package has already been
+// reported by it; any other is a *flagError.
+func parseFlags(flags *flag.FlagSet, f *flagValues, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if f.configPath != "" {
+		if err := applyConfig(flags, f.configPath); err != nil {
+			return invalidFlag("config", "%v", err)
+		}
+	}
+	if f.target != "" {
+		if err := applyTarget(flags, f.target); err != nil {
+			return invalidFlag("target", "%v", err)
+		}
+	}
+	flags.Visit(func(given *flag.Flag) {
+		switch given.Name {
+		case "source-field":
+			f.sourceKeySet = true
+		case "workers":
+			f.workersSet = true
+		}
+	})
+	return nil
+}
+
+// flagError is an invalid flag value, or a flag given with others it can't
+// be combined with.
+type flagError struct {
+	name string
+	msg  string
+}
+
+func (e *flagError) Error() string {
+	return fmt.Sprintf("Invalid --%s value: %s", e.name, e.msg)
+}
+
+// invalidFlag returns a *flagError for the flag name, with the message
+// formatted as by fmt.Sprintf.
+func invalidFlag(name, format string, args ...interface{}) error {
+	return &flagError{name: name, msg: fmt.Sprintf(format, args...)}
+}
 
-		var wg sync.WaitGroup
+// buildOptions checks the flag values in f and how they are combined, and
+// returns the converter options they ask for, less the callbacks and sinks
+// that run sets up. f is completed along the way: defaults that depend on
+// other flags are filled in and the derived fields set. On error it returns
+// the exit status to end with: 2 for an invalid flag, or 1 when the input
+// can't be found.
+func buildOptions(f *flagValues, stdin io.Reader) (opts converter.Options, code int, err error) {
+	// pretty-array is shorthand for an indented json-array
+	if f.format == "pretty-array" {
+		f.format = converter.FormatJSONArray
+		f.pretty = true
+	}
 
-		// Create a JSON file and an encoder
-		outputFile, err := os.Create(outputPath)
+	// Read from stdin when --file is omitted or given as "-"
+	if len(f.filePaths) == 0 {
+		f.filePaths = stringList{"-"}
+	}
+	f.paths, err = expandFilePaths(f.filePaths, f.recursive)
+	if err != nil {
+		return opts, 1, err
+	}
+	if f.inputCmd != "" && !strings.Contains(f.inputCmd, "{file}") {
+		return opts, 2, invalidFlag("input-cmd", "must contain {file}, got %v", f.inputCmd)
+	}
+	for _, filePath := range f.paths {
+		if filePath == "-" && f.inputCmd != "" {
+			return opts, 2, invalidFlag("input-cmd", "runs on files given with --file, not stdin")
+		}
+		if filePath == "-" && stdinIsTerminal(stdin) {
+			return opts, 1, errors.New("no input: give a file path with --file, or pipe CSV data on stdin")
+		}
+	}
+	// --output-dir is a template naming each output after its input, with
+	// the extension of the format
+	templateFlag := "output-template"
+	if f.outputDir != "" {
+		if f.outputTemplate != "" {
+			return opts, 2, invalidFlag("output-dir", "can't be combined with --output-template")
+		}
+		templateFlag = "output-dir"
+		f.outputTemplate = filepath.Join(f.outputDir, "{name}") + formatExtension(f.format, f.gzipOut)
+	}
+	if f.outputTemplate != "" {
+		if f.outputPath != "" || f.outputURL != "" || f.sqlitePath != "" || f.splitLines > 0 || f.appendOutput || f.inferSchema {
+			return opts, 2, invalidFlag(templateFlag, "can't be combined with --output, --output-url, --sqlite, --split-lines, --append or --infer-schema")
+		}
+		f.outputPaths, err = templatePaths(f.outputTemplate, f.paths)
 		if err != nil {
-			fmt.Println("Error creating JSON file:", err)
-			return
+			return opts, 2, invalidFlag(templateFlag, "%v", err)
 		}
-		defer outputFile.Close()
+	}
+	// Rows from several files are tagged with where they came from, unless
+	// each file has an output of its own
+	if !f.sourceKeySet && len(f.paths) > 1 && f.outputPaths == nil {
+		f.sourceKey = "_source"
+	}
+	if strings.HasSuffix(f.outputPath, ".gz") {
+		f.gzipOut = true
+	}
 
-		encoder := json.NewEncoder(outputFile)
-		encoder.SetIndent("", "  ")
+	switch f.progressMode {
+	case "bar", "json", "none":
+	default:
+		return opts, 2, invalidFlag("progress", "must be bar, json or none, got %v", f.progressMode)
+	}
 
-		// Start multiple workers (e.g., 6 workers)
-		workerCount := 6
-		resultMutex := sync.Mutex{} // Mutex to protect the JSON file writing
+	switch f.logFormat {
+	case "text", "json":
+	default:
+		return opts, 2, invalidFlag("log-format", "must be text or json, got %v", f.logFormat)
+	}
 
-		for i := 0; i < workerCount; i++ {
-			wg.Add(1)
-			go worker(i, tasks, outputPath, &wg, &resultMutex, encoder)
+	// Leaving --workers out picks a count; 0 is not a way of asking for that
+	if f.workersSet && f.workerCount < 1 {
+		return opts, 2, invalidFlag("workers", "must be at least 1, got %v", f.workerCount)
+	}
+	if f.rateLimit < 0 {
+		return opts, 2, invalidFlag("rate", "must not be negative, got %v", f.rateLimit)
+	}
+	if f.queueSize < 0 {
+		return opts, 2, invalidFlag("queue-size", "must not be negative, got %v", f.queueSize)
+	}
+	switch f.format {
+	case converter.FormatJSONL, converter.FormatJSONArray, converter.FormatCSV, converter.FormatYAML, formatParquet:
+	default:
+		return opts, 2, invalidFlag("format", "must be jsonl, json-array, pretty-array, csv, yaml or parquet, got %v", f.format)
+	}
+	// Parquet files are written whole by their own code, so they can't be
+	// compressed afterwards, split, posted or combined with another sink
+	if f.format == formatParquet && (f.gzipOut || f.splitLines > 0 || f.outputURL != "" || f.sqlitePath != "" || f.inferSchema || f.partitionBy != "" || f.withTrailer || f.outputTemplate != "") {
+		return opts, 2, invalidFlag("format", "parquet can't be combined with --gzip-out, --split-lines, --output-url, --sqlite, --infer-schema, --partition-by, --with-trailer, --output-template or --output-dir")
+	}
+	if f.splitLines < 0 {
+		return opts, 2, invalidFlag("split-lines", "must not be negative, got %v", f.splitLines)
+	}
+	if f.splitLines > 0 && f.outputPath == "" {
+		return opts, 2, invalidFlag("split-lines", "requires --output")
+	}
+	if f.appendOutput && f.outputPath == "" {
+		return opts, 2, invalidFlag("append", "requires --output")
+	}
+	if f.appendOutput && f.format != converter.FormatJSONL {
+		// Other formats have framing, such as brackets or a header, that
+		// can't be continued
+		return opts, 2, invalidFlag("append", "requires --format jsonl, got %v", f.format)
+	}
+	if f.actionLine != "" {
+		if f.format != converter.FormatJSONL || f.batchSize > 0 {
+			return opts, 2, invalidFlag("action-line", "requires --format jsonl without --batch-size")
+		}
+		if !json.Valid([]byte(f.actionLine)) || strings.ContainsAny(f.actionLine, "\r\n") {
+			return opts, 2, invalidFlag("action-line", "must be a single line of JSON, got %v", f.actionLine)
 		}
+	}
+	if f.outputURL != "" {
+		if f.outputPath != "" || f.gzipOut || f.splitLines > 0 || f.appendOutput {
+			return opts, 2, invalidFlag("output-url", "can't be combined with --output, --gzip-out, --split-lines or --append")
+		}
+		if f.format != converter.FormatJSONL || f.actionLine != "" {
+			return opts, 2, invalidFlag("output-url", "requires --format jsonl without --action-line")
+		}
+		if f.outputRetries < 0 {
+			return opts, 2, invalidFlag("output-retries", "must not be negative, got %v", f.outputRetries)
+		}
+		// Rows are always posted in batches
+		if f.batchSize == 0 {
+			f.batchSize = 100
+		}
+		f.outputHeaders, err = parseHeaders(f.outputHeaderArgs)
+		if err != nil {
+			return opts, 2, invalidFlag("output-header", "%v", err)
+		}
+	}
+	if (f.sqlitePath == "") != (f.sqliteTableName == "") {
+		return opts, 2, invalidFlag("sqlite", "--sqlite and --table must be given together")
+	}
+	if f.sqlitePath != "" && (f.outputPath != "" || f.outputURL != "" || f.gzipOut || f.splitLines > 0 || f.appendOutput || f.batchSize > 0 || f.actionLine != "") {
+		return opts, 2, invalidFlag("sqlite", "can't be combined with --output, --output-url, --gzip-out, --split-lines, --append, --batch-size or --action-line")
+	}
+	if f.inferSchema {
+		if f.sqlitePath != "" || f.outputURL != "" || f.splitLines > 0 || f.appendOutput || f.batchSize > 0 || f.actionLine != "" {
+			return opts, 2, invalidFlag("infer-schema", "can't be combined with --sqlite, --output-url, --split-lines, --append, --batch-size or --action-line")
+		}
+		f.inferTypes = true
+	}
+	if f.partitionBy != "" {
+		if f.outputPath == "" || f.outputURL != "" || f.sqlitePath != "" || f.inferSchema || f.splitLines > 0 || f.outputTemplate != "" || f.withTrailer {
+			return opts, 2, invalidFlag("partition-by", "requires --output, and can't be combined with --output-url, --sqlite, --infer-schema, --split-lines, --output-template, --output-dir or --with-trailer")
+		}
+		if f.maxPartitions < 1 {
+			return opts, 2, invalidFlag("max-partitions", "must be at least 1, got %v", f.maxPartitions)
+		}
+	}
+	if f.withTrailer && (f.format == converter.FormatCSV || f.sqlitePath != "" || f.outputURL != "" || f.inferSchema || f.splitLines > 0 || f.batchSize > 0 || f.actionLine != "") {
+		return opts, 2, invalidFlag("with-trailer", "can't be combined with --format csv, --sqlite, --output-url, --infer-schema, --split-lines, --batch-size or --action-line")
+	}
+	if f.strictColumns && f.requireColumns == "" {
+		return opts, 2, invalidFlag("strict-columns", "requires --require-columns")
+	}
+	if f.preserveFieldOrder && f.format != converter.FormatJSONL && f.format != converter.FormatJSONArray {
+		return opts, 2, invalidFlag("preserve-field-order", "requires --format jsonl or json-array, got %v", f.format)
+	}
+	if f.pretty {
+		if f.format != converter.FormatJSONL && f.format != converter.FormatJSONArray {
+			return opts, 2, invalidFlag("pretty", "requires --format jsonl or json-array, got %v", f.format)
+		}
+		if f.batchSize > 0 || f.actionLine != "" || f.outputURL != "" {
+			return opts, 2, invalidFlag("pretty", "can't be combined with --batch-size, --action-line or --output-url")
+		}
+		if f.indent == "tab" {
+			f.indent = "\t"
+		}
+		if f.indent == "" || strings.Trim(f.indent, " \t") != "" {
+			return opts, 2, invalidFlag("indent", "must be spaces or tabs, got %q", f.indent)
+		}
+	}
+	if f.batchSize < 0 {
+		return opts, 2, invalidFlag("batch-size", "must not be negative, got %v", f.batchSize)
+	}
+	if f.batchSize > 0 && f.format != converter.FormatJSONL {
+		return opts, 2, invalidFlag("batch-size", "requires --format jsonl, got %v", f.format)
+	}
+	// With auto, the comma only stands in until each file's header is seen
+	detectDelimiter := f.delimiterArg == "auto"
+	delimiter := ','
+	if !detectDelimiter {
+		delimiter, err = parseDelimiter(f.delimiterArg)
+		if err != nil {
+			return opts, 2, invalidFlag("delimiter", "%v", err)
+		}
+	}
+	var widths []int
+	for _, value := range splitList(f.widthsArg) {
+		width, err := strconv.Atoi(value)
+		if err != nil || width < 1 {
+			return opts, 2, invalidFlag("widths", "must be positive whole numbers, got %v", value)
+		}
+		widths = append(widths, width)
+	}
+	if widths != nil && f.splitRegexArg != "" {
+		return opts, 2, invalidFlag("widths", "can't be combined with --split-regex")
+	}
+	if detectDelimiter && (widths != nil || f.splitRegexArg != "") {
+		return opts, 2, invalidFlag("delimiter", "auto can't be combined with --widths or --split-regex")
+	}
+	var comment rune
+	if f.commentChar != "" {
+		comment, err = parseDelimiter(f.commentChar)
+		if err == nil && comment == delimiter && !detectDelimiter {
+			err = fmt.Errorf("must differ from the delimiter, got %q", f.commentChar)
+		}
+		if err != nil {
+			return opts, 2, invalidFlag("comment-char", "%v", err)
+		}
+	}
+	var splitRegex *regexp.Regexp
+	if f.splitRegexArg != "" {
+		splitRegex, err = regexp.Compile(f.splitRegexArg)
+		if err != nil {
+			return opts, 2, invalidFlag("split-regex", "%v", err)
+		}
+		// A pattern matching nothing at all would split between every
+		// character
+		if splitRegex.MatchString("") {
+			return opts, 2, invalidFlag("split-regex", "must not match an empty string, got %v", f.splitRegexArg)
+		}
+	}
+	if f.limit < 0 {
+		return opts, 2, invalidFlag("limit", "must not be negative, got %v", f.limit)
+	}
+	if f.sample <= 0 || f.sample > 1 {
+		return opts, 2, invalidFlag("sample", "must be above 0 and at most 1, got %v", f.sample)
+	}
+	if f.timeout < 0 {
+		return opts, 2, invalidFlag("timeout", "must not be negative, got %v", f.timeout)
+	}
+	if f.maxFieldSize < 0 {
+		return opts, 2, invalidFlag("max-field-size", "must not be negative, got %v", f.maxFieldSize)
+	}
+	if f.skipRows < 0 {
+		return opts, 2, invalidFlag("skip-rows", "must not be negative, got %v", f.skipRows)
+	}
+	switch f.keyCase {
+	case converter.KeyCaseLower, converter.KeyCaseOriginal, converter.KeyCaseUpper, converter.KeyCaseSnake:
+	default:
+		return opts, 2, invalidFlag("key-case", "must be original, lower, upper or snake, got %v", f.keyCase)
+	}
+	switch f.valueCase {
+	case "", converter.KeyCaseLower, converter.KeyCaseUpper:
+	default:
+		return opts, 2, invalidFlag("value-case", "must be lower or upper, got %v", f.valueCase)
+	}
 
-		// Start a goroutine to read and parse the CSV file
-		wg.Add(1)
-		go readAndParseCSV(filePath, tasks, estimatedTotalLines, &wg)
+	if f.nest && f.nestSeparator == "" {
+		return opts, 2, invalidFlag("nest-separator", "must not be empty")
+	}
+	nestBy := ""
+	if f.nest {
+		nestBy = f.nestSeparator
+	}
 
-		// Wait for all goroutines to finish
-		wg.Wait()
+	lineFieldKey := ""
+	if f.withLineNumber {
+		if f.lineKey == "" {
+			return opts, 2, invalidFlag("line-field", "must not be empty")
+		}
+		lineFieldKey = f.lineKey
+	}
 
-		fmt.Println("Conversion complete!")
-		endTime := time.Now()
-		processTime := endTime.Sub(startTime).Seconds()
-		fmt.Printf("File name: %s\n", filePath)
-		fmt.Printf("Processing time: %.2f seconds\n", processTime)
-	} else {
-		fmt.Println("Please provide a file path using the --file argument.")
+	hashFieldKey := ""
+	if f.addHash {
+		if f.hashKey == "" {
+			return opts, 2, invalidFlag("hash-field", "must not be empty")
+		}
+		hashFieldKey = f.hashKey
 	}
+
+	var transforms []converter.Transform
+	for _, spec := range f.transformArgs {
+		transform, err := converter.ParseTransform(spec)
+		if err != nil {
+			return opts, 2, invalidFlag("transform", "%v", err)
+		}
+		transforms = append(transforms, transform)
+	}
+	var where []converter.Condition
+	for _, expr := range f.whereArgs {
+		condition, err := converter.ParseCondition(expr)
+		if err != nil {
+			return opts, 2, invalidFlag("where", "%v", err)
+		}
+		where = append(where, condition)
+	}
+	arrayColumns, err := parseArrayColumns(f.arrayColumnArgs)
+	if err != nil {
+		return opts, 2, invalidFlag("array-columns", "%v", err)
+	}
+	dateColumns, err := parseDateColumns(f.dateColumnArgs)
+	if err != nil {
+		return opts, 2, invalidFlag("date-columns", "%v", err)
+	}
+
+	addFields, err := parseAddFields(f.addFieldArgs)
+	if err != nil {
+		return opts, 2, invalidFlag("add-field", "%v", err)
+	}
+
+	rename, err := parseRename(f.renameArg)
+	if err != nil {
+		return opts, 2, invalidFlag("rename", "%v", err)
+	}
+
+	schema, err := loadSchema(f.schemaPath)
+	if err != nil {
+		return opts, 2, invalidFlag("schema", "%v", err)
+	}
+
+	headers := splitList(f.headersArg)
+	if f.columnsFile != "" {
+		if f.headersArg != "" {
+			return opts, 2, invalidFlag("columns-file", "can't be combined with --headers")
+		}
+		headers, err = loadColumnsFile(f.columnsFile, delimiter)
+		if err != nil {
+			return opts, 2, invalidFlag("columns-file", "%v", err)
+		}
+		f.noHeader = true
+	}
+	selected := splitList(f.selectArg)
+	excluded := splitList(f.excludeArg)
+	positions, err := parseColumnRange(f.columnRange)
+	if err != nil {
+		return opts, 2, invalidFlag("column-range", "%v", err)
+	}
+	var nullValues []string
+	if f.nullValuesArg != "" {
+		// Split without trimming: null tokens are matched exactly
+		nullValues = strings.Split(f.nullValuesArg, ",")
+	}
+
+	var prettyIndent string
+	if f.pretty {
+		prettyIndent = f.indent
+	}
+	opts = converter.Options{
+		Workers:             f.workerCount,
+		QueueSize:           f.queueSize,
+		Rate:                f.rateLimit,
+		Delimiter:           delimiter,
+		DetectDelimiter:     detectDelimiter,
+		LazyQuotes:          f.lazyQuotes,
+		TrimLeadingSpace:    f.trimLeadingSpace,
+		Comment:             comment,
+		SplitRegex:          splitRegex,
+		Widths:              widths,
+		MaxFieldSize:        f.maxFieldSize,
+		Encoding:            f.inputEncoding,
+		Format:              f.format,
+		YAMLSequence:        f.yamlSequence,
+		Indent:              prettyIndent,
+		PreserveOrder:       f.preserveFieldOrder,
+		BatchSize:           f.batchSize,
+		ActionLine:          f.actionLine,
+		Ordered:             f.ordered,
+		ConcurrentSources:   f.concurrentFiles,
+		Trim:                f.trim,
+		NullValues:          nullValues,
+		NullCaseInsensitive: f.nullCaseInsensitive,
+		OmitEmpty:           f.omitEmpty,
+		InferTypes:          f.inferTypes,
+		StringColumns:       splitList(f.stringColumnsArg),
+		NoHeader:            f.noHeader,
+		Headers:             headers,
+		KeyCase:             f.keyCase,
+		ValueCase:           f.valueCase,
+		Select:              selected,
+		Positions:           positions,
+		Rename:              rename,
+		Exclude:             excluded,
+		NestSeparator:       nestBy,
+		SkipRows:            f.skipRows,
+		Limit:               f.limit,
+		DateColumns:         dateColumns,
+		ArrayColumns:        arrayColumns,
+		Where:               where,
+		Transforms:          transforms,
+		DedupOn:             splitList(f.dedupOn),
+		Sample:              f.sample,
+		Seed:                f.seed,
+		EmptyArrayNull:      f.emptyArrayNull,
+		SkipInvalidDates:    f.skipInvalidDates,
+		Schema:              schema,
+		RequireColumns:      splitList(f.requireColumns),
+		StrictColumns:       f.strictColumns,
+		Strict:              f.strict,
+		OverflowKey:         f.overflowKey,
+		SourceKey:           f.sourceKey,
+		AddFields:           addFields,
+		LineKey:             lineFieldKey,
+		HashKey:             hashFieldKey,
+	}
+	return opts, 0, nil
+}
+
+// interrupted reports whether err is the cancellation of a conversion by a
+// signal or --timeout.
+func interrupted(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// autoWorkers chooses a worker count for an input of total bytes when
+// --workers isn't given: one worker per 4 MiB, so that a small file isn't
+// spread over goroutines that would mostly wait on each other, up to one per
+// CPU. An input of unknown size, such as stdin, gets one per CPU.
+func autoWorkers(total int64) int {
+	const bytesPerWorker = 4 << 20
+	cpus := runtime.NumCPU()
+	if total < 0 || total/bytesPerWorker >= int64(cpus) {
+		return cpus
+	}
+	return int(total/bytesPerWorker) + 1
+}
+
+// outputWriter is an output file, or stdout when file is nil, optionally
+// gzip-compressed. A new file is written to tmpPath and only renamed to path,
+// or with appending added to the end of it, by commit.
+type outputWriter struct {
+	io.Writer
+	file      *os.File
+	gzip      *gzip.Writer
+	path      string
+	tmpPath   string
+	appending bool
+}
+
+// createOutput creates a temporary file next to path. A path that exists but
+// isn't a regular file is opened directly. With appending set the rows are
+// still staged in the temporary file, and commit adds them to the file at
+// path; a gzip stream appended this way becomes a further member of the
+// file, which gzip readers decompress as one. With makeDirs set, missing
+// parent directories are created first.
+func createOutput(path string, gzipped, appending, makeDirs bool) (*outputWriter, error) {
+	if err := makeOutputDir(filepath.Dir(path), makeDirs); err != nil {
+		return nil, err
+	}
+	var f *os.File
+	var tmpPath string
+	var err error
+	switch {
+	case !replaceable(path) && appending:
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	case !replaceable(path):
+		// A device or pipe such as /dev/stdout is written in place;
+		// renaming over it would replace it with a regular file
+		f, err = os.Create(path)
+	default:
+		// Same directory, so the final rename can't cross filesystems
+		f, err = os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+		if err == nil {
+			tmpPath = f.Name()
+			err = f.Chmod(0o644)
+		}
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+			os.Remove(tmpPath)
+		}
+		return nil, err
+	}
+	output := newOutputWriter(f, gzipped)
+	output.file, output.path, output.tmpPath = f, path, tmpPath
+	output.appending = appending
+	return output, nil
+}
+
+// newOutputWriter writes to w, through gzip when gzipped is set, as for
+// stdout.
+func newOutputWriter(w io.Writer, gzipped bool) *outputWriter {
+	output := &outputWriter{Writer: w}
+	if gzipped {
+		output.gzip = gzip.NewWriter(w)
+		output.Writer = output.gzip
+	}
+	return output
+}
+
+// Close flushes the gzip stream, if any, and closes the file.
+func (o *outputWriter) Close() error {
+	var err error
+	if o.gzip != nil {
+		err = o.gzip.Close()
+	}
+	if o.file != nil {
+		if closeErr := o.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// replaceable reports whether path is missing or a regular file, so that a
+// temporary file can be renamed over it.
+func replaceable(path string) bool {
+	info, err := os.Stat(path)
+	return err != nil || info.Mode().IsRegular()
+}
+
+// commit moves a finished temporary file to its final path, or with
+// appending adds its contents to the end of the file there.
+func (o *outputWriter) commit() error {
+	if o.tmpPath == "" {
+		return nil
+	}
+	if o.appending {
+		return appendFile(o.path, o.tmpPath)
+	}
+	return os.Rename(o.tmpPath, o.path)
+}
+
+// appendFile adds the contents of the file at from to the end of the file at
+// path, creating it if need be, and then removes from. Should the copy fail
+// part way, path is truncated back to its old size.
+func appendFile(path, from string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666)
+	if err != nil {
+		return err
+	}
+	info, err := dst.Stat()
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Truncate(info.Size())
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	src.Close()
+	os.Remove(from)
+	return nil
+}
+
+// discard removes a temporary file that won't be committed.
+func (o *outputWriter) discard() {
+	if o.tmpPath != "" {
+		os.Remove(o.tmpPath)
+	}
+}
+
+// suspend closes the file, writing any gzip trailer, until resume reopens
+// it.
+func (o *outputWriter) suspend() error {
+	err := o.Close()
+	o.Writer, o.file, o.gzip = nil, nil, nil
+	return err
+}
+
+// resume reopens a suspended file to append to it. A gzip stream continues
+// as a further member of the file.
+func (o *outputWriter) resume(gzipped bool) error {
+	path := o.path
+	if o.tmpPath != "" {
+		path = o.tmpPath
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	o.file, o.Writer = f, f
+	if gzipped {
+		o.gzip = gzip.NewWriter(f)
+		o.Writer = o.gzip
+	}
+	return nil
+}
+
+// partitionFiles keeps at most max --partition-by files open. Making room
+// for another closes the least recently written, which is reopened when a
+// row for it next turns up, so a column with many values doesn't run out of
+// file descriptors. The writer goroutine is its only user.
+type partitionFiles struct {
+	max   int
+	files []*partitionFile
+	open  int
+	// clock orders the writes, for finding the least recent.
+	clock uint64
+}
+
+// partitionFile is a partition's output, reopened on a write after
+// partitionFiles closed it.
+type partitionFile struct {
+	*outputWriter
+	files   *partitionFiles
+	gzipped bool
+	closed  bool
+	written uint64
+}
+
+// create creates the output of a new partition, as createOutput does.
+func (p *partitionFiles) create(path string, gzipped, appending bool) (*partitionFile, error) {
+	if err := p.makeRoom(); err != nil {
+		return nil, err
+	}
+	output, err := createOutput(path, gzipped, appending, false)
+	if err != nil {
+		return nil, err
+	}
+	f := &partitionFile{outputWriter: output, files: p, gzipped: gzipped}
+	p.files = append(p.files, f)
+	p.open++
+	return f, nil
+}
+
+// makeRoom closes the least recently written file if max are open.
+func (p *partitionFiles) makeRoom() error {
+	if p.open < p.max {
+		return nil
+	}
+	var oldest *partitionFile
+	for _, f := range p.files {
+		if !f.closed && (oldest == nil || f.written < oldest.written) {
+			oldest = f
+		}
+	}
+	oldest.closed = true
+	p.open--
+	if err := oldest.suspend(); err != nil {
+		return fmt.Errorf("closing %s: %w", oldest.path, err)
+	}
+	return nil
+}
+
+func (f *partitionFile) Write(b []byte) (int, error) {
+	if f.closed {
+		if err := f.files.makeRoom(); err != nil {
+			return 0, err
+		}
+		if err := f.resume(f.gzipped); err != nil {
+			return 0, fmt.Errorf("reopening %s: %w", f.path, err)
+		}
+		f.closed = false
+		f.files.open++
+	}
+	f.files.clock++
+	f.written = f.files.clock
+	return f.outputWriter.Write(b)
+}
+
+// partPath numbers an output path for --split-lines, inserting the part
+// before the extension: out.json becomes out.0.json and out.json.gz becomes
+// out.0.json.gz.
+func partPath(path string, part int) string {
+	gz := ""
+	if strings.HasSuffix(path, ".gz") {
+		path, gz = strings.TrimSuffix(path, ".gz"), ".gz"
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s%s", strings.TrimSuffix(path, ext), part, ext, gz)
+}
+
+// makeOutputDir checks that dir exists, or with makeDirs creates it and any
+// missing parents.
+func makeOutputDir(dir string, makeDirs bool) error {
+	if makeDirs {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("creating output directory: %w", err)
+		}
+		return nil
+	}
+	info, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("output directory %s does not exist; use --mkdir to create it", dir)
+	case err == nil && !info.IsDir():
+		return fmt.Errorf("output directory %s is not a directory", dir)
+	}
+	// Any other problem is reported when the file is created
+	return nil
+}
+
+// partitionFileName names the --partition-by file for a value, Hive style:
+// region=US. The value is escaped so that it can't reach outside the
+// directory, and an empty one gets Hive's placeholder for null.
+func partitionFileName(column, value string) string {
+	if value == "" {
+		value = "__HIVE_DEFAULT_PARTITION__"
+	}
+	return url.PathEscape(column) + "=" + url.PathEscape(value)
+}
+
+// formatExtension is the file extension for an output format.
+func formatExtension(format string, gzipped bool) string {
+	ext := "." + format
+	if format == converter.FormatJSONArray {
+		ext = ".json"
+	}
+	if gzipped {
+		ext += ".gz"
+	}
+	return ext
+}
+
+// rejectWriter records rows the converter left out as CSV: the source, line
+// number and reason, followed by the row's fields as read. It is safe for
+// concurrent use.
+type rejectWriter struct {
+	mu  sync.Mutex
+	out *csv.Writer
+	err error
+}
+
+func newRejectWriter(w io.Writer) *rejectWriter {
+	out := csv.NewWriter(w)
+	// Rows carry a variable number of fields, so the header names only the
+	// leading columns
+	out.Write([]string{"source", "line", "reason", "fields"})
+	return &rejectWriter{out: out}
+}
+
+func (r *rejectWriter) write(source string, line int, record []string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	row := append([]string{source, strconv.Itoa(line), reason}, record...)
+	r.err = r.out.Write(row)
+}
+
+// flush writes any buffered rows and reports the first error encountered.
+func (r *rejectWriter) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.out.Flush()
+	if r.err != nil {
+		return r.err
+	}
+	return r.out.Error()
+}
+
+// newTrailer returns a converter.Options.Trailer for --with-trailer that
+// describes a conversion of the named files starting now.
+func newTrailer(files []string) func(converter.Stats) map[string]interface{} {
+	start := time.Now()
+	return func(stats converter.Stats) map[string]interface{} {
+		return map[string]interface{}{"_meta": map[string]interface{}{
+			"rows":        stats.Written,
+			"read":        stats.Read,
+			"skipped":     stats.Skipped,
+			"invalid":     stats.Invalid,
+			"filtered":    stats.Filtered,
+			"duplicates":  stats.Duplicates,
+			"errors":      stats.Errors,
+			"files":       files,
+			"duration_ms": time.Since(start).Milliseconds(),
+		}}
+	}
+}
+
+// sourceNames lists the names of sources.
+func sourceNames(sources []converter.Source) []string {
+	names := make([]string, len(sources))
+	for i, source := range sources {
+		names[i] = source.Name
+	}
+	return names
+}
+
+// logError reports an error to w, or as a log record when logger is set.
+func logError(w io.Writer, logger *slog.Logger, msg string, err error) {
+	if logger != nil {
+		logger.Error(msg, "error", err)
+		return
+	}
+	fmt.Fprintf(w, "%s: %v\n", msg, err)
 }
 
-func evaluateTotalLines(filePath string) (int, error) {
-	file, err := os.Open(filePath)
+// logSummary logs the outcome and row counts of a conversion as a single
+// record, at error level when it failed.
+func logSummary(logger *slog.Logger, sources []converter.Source, result string, err error, stats converter.Stats, processTime float64) {
+	level := slog.LevelInfo
+	switch result {
+	case "interrupted":
+		level = slog.LevelWarn
+	case "failed", "timed out":
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{
+		slog.String("result", result),
+		slog.Any("files", sourceNames(sources)),
+		slog.Int("read", stats.Read),
+		slog.Int("written", stats.Written),
+		slog.Int("skipped", stats.Skipped),
+		slog.Int("invalid", stats.Invalid),
+		slog.Int("filtered", stats.Filtered),
+		slog.Int("duplicates", stats.Duplicates),
+		slog.Int("errors", stats.Errors),
+		slog.Float64("seconds", processTime),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	logger.LogAttrs(context.Background(), level, "conversion finished", attrs...)
+}
+
+// printSummary reports the outcome and row counts of a conversion.
+func printSummary(w io.Writer, sources []converter.Source, result string, stats converter.Stats, processTime float64) {
+	names := sourceNames(sources)
+	fmt.Fprintln(w, "Summary")
+	fmt.Fprintln(w, "=================")
+	fmt.Fprintf(w, "File name:       %s\n", strings.Join(names, ", "))
+	fmt.Fprintf(w, "Result:          %s\n", result)
+	fmt.Fprintf(w, "Rows read:       %d\n", stats.Read)
+	fmt.Fprintf(w, "Rows written:    %d\n", stats.Written)
+	fmt.Fprintf(w, "Rows skipped:    %d\n", stats.Skipped)
+	fmt.Fprintf(w, "Rows invalid:    %d\n", stats.Invalid)
+	fmt.Fprintf(w, "Rows filtered:   %d\n", stats.Filtered)
+	fmt.Fprintf(w, "Duplicates:      %d\n", stats.Duplicates)
+	fmt.Fprintf(w, "Write errors:    %d\n", stats.Errors)
+	fmt.Fprintf(w, "Processing time: %.2f seconds\n", processTime)
+	if processTime > 0 {
+		fmt.Fprintf(w, "Throughput:      %.0f rows/sec\n", float64(stats.Written)/processTime)
+	}
+}
+
+// loadSchema reads the --schema file, if one was given.
+func loadSchema(path string) (*converter.Schema, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer file.Close()
+	return converter.ParseSchema(file)
+}
+
+// loadColumnsFile reads the --columns-file names: one per line, or a single
+// header line separated like the data. Blank lines are ignored.
+func loadColumnsFile(path string, delimiter rune) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	switch len(lines) {
+	case 0:
+		return nil, fmt.Errorf("%s: no column names", path)
+	case 1:
+		reader := csv.NewReader(strings.NewReader(lines[0]))
+		reader.Comma = delimiter
+		names, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return names, nil
+	}
+	return lines, nil
+}
+
+// expandFilePaths expands any glob patterns among the --file arguments, and
+// directories when recursive is set. A pattern that matches nothing is an
+// error rather than silently skipped.
+func expandFilePaths(patterns []string, recursive bool) ([]string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		var matches []string
+		var err error
+		switch {
+		case strings.Contains(pattern, "**"):
+			matches, err = globStar(pattern)
+		case strings.ContainsAny(pattern, "*?["):
+			matches, err = filepath.Glob(pattern)
+		default:
+			if info, statErr := os.Stat(pattern); statErr == nil && info.IsDir() {
+				if !recursive {
+					return nil, fmt.Errorf("%s is a directory; use --recursive to convert the files under it", pattern)
+				}
+				matches, err = csvFilesUnder(pattern)
+				break
+			}
+			paths = append(paths, pattern)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// csvFilesUnder lists the .csv and .csv.gz files in the tree under dir, in
+// lexical order.
+func csvFilesUnder(dir string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && (strings.HasSuffix(path, ".csv") || strings.HasSuffix(path, ".csv.gz")) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// globStar expands a pattern in which a ** path element matches any number
+// of directories, including none, and the other elements are matched as by
+// filepath.Match. Matches are in lexical order.
+func globStar(pattern string) ([]string, error) {
+	elems := strings.Split(filepath.ToSlash(pattern), "/")
+	// Walk from the longest leading run of elements without wildcards
+	n := 0
+	for n < len(elems) && !strings.ContainsAny(elems[n], "*?[") {
+		n++
+	}
+	root := strings.Join(elems[:n], "/")
+	if root == "" && n > 0 {
+		root = "/"
+	} else if root == "" {
+		root = "."
+	}
+	rest := elems[n:]
+	for _, elem := range rest {
+		if _, err := filepath.Match(elem, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	var paths []string
+	err := filepath.WalkDir(filepath.FromSlash(root), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(filepath.FromSlash(root), path)
+		if err != nil {
+			return err
+		}
+		if matchElems(rest, strings.Split(filepath.ToSlash(rel), "/")) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return paths, err
+}
 
-	scanner := bufio.NewScanner(file)
-	lineCount := 0
-	for scanner.Scan() {
-		lineCount++
+// matchElems reports whether the path elements match the pattern elements,
+// with ** matching any run of elements.
+func matchElems(pattern, elems []string) bool {
+	if len(pattern) == 0 {
+		return len(elems) == 0
 	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if matchElems(pattern[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	ok, _ := filepath.Match(pattern[0], elems[0])
+	return ok && matchElems(pattern[1:], elems[1:])
+}
 
-	if err := scanner.Err(); err != nil {
-		return 0, err
+// templatePaths names the output file of each input from an
+// --output-template. Every input needs an output of its own, so stdin and
+// templates giving two inputs the same output are rejected.
+func templatePaths(template string, inputs []string) ([]string, error) {
+	if !strings.Contains(template, "{name}") {
+		return nil, errors.New("must contain {name}")
+	}
+	paths := make([]string, len(inputs))
+	seen := make(map[string]string, len(inputs))
+	for i, input := range inputs {
+		if input == "-" {
+			return nil, errors.New("can't name an output for stdin")
+		}
+		name := filepath.Base(input)
+		name = strings.TrimSuffix(name, ".gz")
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		path := strings.NewReplacer("{dir}", filepath.Dir(input), "{name}", name).Replace(template)
+		path = filepath.Clean(path)
+		if other, ok := seen[path]; ok {
+			return nil, fmt.Errorf("%s and %s would both be written to %s", other, input, path)
+		}
+		if path == filepath.Clean(input) {
+			return nil, fmt.Errorf("%s would be overwritten by its own output", input)
+		}
+		seen[path] = input
+		paths[i] = path
 	}
+	return paths, nil
+}
+
+// convertedFile is an output written by convertEach, and the counts of its
+// input alone.
+type convertedFile struct {
+	Source string
+	Path   string
+	Stats  converter.Stats
+}
 
-	// Return lineCount - 1 to account for the header row
-	return lineCount - 1, nil
+// convertEach converts each source to the output at the same index, one
+// after another, stopping at the first failure. Each output is moved into
+// place as soon as it is complete, so a failure only loses the file being
+// converted, which keepPartial keeps when the conversion is interrupted.
+// It returns the outputs written, along with the counts of them all.
+func convertEach(ctx context.Context, sources []converter.Source, paths []string, gzipped, makeDirs, keepPartial bool, opts converter.Options) ([]convertedFile, converter.Stats, error) {
+	var converted []convertedFile
+	var total converter.Stats
+	for i, source := range sources {
+		output, err := createOutput(paths[i], gzipped || strings.HasSuffix(paths[i], ".gz"), false, makeDirs)
+		if err != nil {
+			return converted, total, err
+		}
+		// Each file's trailer describes that file alone
+		if opts.Trailer != nil {
+			opts.Trailer = newTrailer([]string{source.Name})
+		}
+		stats, err := converter.ConvertSources(ctx, []converter.Source{source}, output, opts)
+		total.Add(stats)
+		if closeErr := output.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err == nil || (keepPartial && interrupted(err)) {
+			if commitErr := output.commit(); commitErr != nil {
+				err = commitErr
+				output.discard()
+			} else {
+				converted = append(converted, convertedFile{Source: source.Name, Path: paths[i], Stats: stats})
+			}
+		} else {
+			output.discard()
+		}
+		if err != nil {
+			return converted, total, err
+		}
+	}
+	return converted, total, nil
+}
+
+// gzipFile closes both the gzip stream and the file underneath it.
+type gzipFile struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// progressReporter is told of every input byte read through Write, and of
+// every row read through Row.
+type progressReporter interface {
+	io.Writer
+	Row()
+	Finish() error
+}
+
+// barProgress draws a bar of bytes read, with their rate and the estimated
+// time remaining, described by the rows read so far and their rate. The
+// description is refreshed on a ticker rather than per row, which would
+// redraw the bar far more often than it can be seen.
+type barProgress struct {
+	*progressbar.ProgressBar
+	total   int64
+	bytes   atomic.Int64
+	rows    atomic.Int64
+	start   time.Time
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newBarProgress(out io.Writer, total int64, interval time.Duration) *barProgress {
+	bar := progressbar.NewOptions64(total,
+		progressbar.OptionSetWriter(out),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSetPredictTime(true),
+		progressbar.OptionShowElapsedTimeOnFinish(),
+		progressbar.OptionSetWidth(10),
+		progressbar.OptionThrottle(65*time.Millisecond),
+		progressbar.OptionOnCompletion(func() {
+			fmt.Fprint(out, "\n")
+		}),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetRenderBlankState(true),
+	)
+	p := &barProgress{ProgressBar: bar, total: total, start: time.Now(), done: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.describe()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// Write counts bytes read. With a known size, the bar is kept short of full
+// until Finish, as it stops being drawn once full, which the bytes reach
+// before the last rows are counted.
+func (p *barProgress) Write(b []byte) (int, error) {
+	after := p.bytes.Add(int64(len(b)))
+	before := after - int64(len(b))
+	if p.total > 0 {
+		before = min(before, p.total-1)
+		after = min(after, p.total-1)
+	}
+	return len(b), p.Add64(after - before)
+}
+
+func (p *barProgress) Row() {
+	p.rows.Add(1)
+}
+
+func (p *barProgress) describe() {
+	rows := p.rows.Load()
+	rate := float64(rows) / time.Since(p.start).Seconds()
+	p.Describe(fmt.Sprintf("%d rows, %.0f rows/s", rows, rate))
+}
+
+// Finish stops refreshing the description and completes the bar.
+func (p *barProgress) Finish() error {
+	close(p.done)
+	<-p.stopped
+	p.describe()
+	if p.total > 0 && p.bytes.Load() >= p.total {
+		// The byte held back by Write
+		return p.Add64(1)
+	}
+	return p.ProgressBar.Finish()
+}
+
+// silentProgress discards progress.
+type silentProgress struct{}
+
+func (silentProgress) Write(b []byte) (int, error) { return len(b), nil }
+func (silentProgress) Row()                        {}
+func (silentProgress) Finish() error               { return nil }
+
+// jsonProgress reports progress as JSON lines of bytes processed so far and
+// the total, if known, at a fixed interval and once more when finished.
+type jsonProgress struct {
+	out       io.Writer
+	total     int64
+	processed atomic.Int64
+	rows      atomic.Int64
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func newJSONProgress(out io.Writer, total int64, interval time.Duration) *jsonProgress {
+	p := &jsonProgress{out: out, total: total, done: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *jsonProgress) Write(b []byte) (int, error) {
+	p.processed.Add(int64(len(b)))
+	return len(b), nil
+}
+
+func (p *jsonProgress) Row() {
+	p.rows.Add(1)
+}
+
+// Finish stops the periodic reports and writes the final one.
+func (p *jsonProgress) Finish() error {
+	close(p.done)
+	<-p.stopped
+	return p.report()
+}
+
+func (p *jsonProgress) report() error {
+	line := struct {
+		Processed int64  `json:"processed"`
+		Total     *int64 `json:"total,omitempty"`
+		Rows      int64  `json:"rows"`
+	}{Processed: p.processed.Load(), Rows: p.rows.Load()}
+	if p.total >= 0 {
+		line.Total = &p.total
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = p.out.Write(append(data, '\n'))
+	return err
+}
+
+// countingFile copies every byte read from a file to a progress writer.
+type countingFile struct {
+	io.Reader
+	io.Closer
+}
+
+// openInput opens filePath, or stdin for "-", or else reads the output of
+// inputCmd run on filePath when set, decompressing it when gzipped is set.
+// The bytes read from the file or command itself are written to progress,
+// and the command's messages to stderr.
+func openInput(filePath, inputCmd string, gzipped bool, stdin io.Reader, stderr, progress io.Writer) (io.ReadCloser, error) {
+	var file io.ReadCloser = io.NopCloser(stdin)
+	switch {
+	case inputCmd != "":
+		c, err := startInputCommand(inputCmd, filePath, stderr)
+		if err != nil {
+			return nil, err
+		}
+		file = c
+	case filePath != "-":
+		f, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+	}
+	file = countingFile{Reader: io.TeeReader(file, progress), Closer: file}
+	if !gzipped {
+		return file, nil
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening gzip input: %w", err)
+	}
+	return gzipFile{Reader: gz, file: file}, nil
+}
+
+// stdinIsTerminal reports whether stdin is attached to a terminal rather than
+// a pipe or redirected file.
+func stdinIsTerminal(stdin io.Reader) bool {
+	f, ok := stdin.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
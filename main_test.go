@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go-worker/converter"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestBarProgress(t *testing.T) {
+	tests := []struct {
+		name  string
+		total int64
+		want  []string
+	}{
+		{"known size", 100, []string{"100%", "100/100 B", "3 rows", "rows/s"}},
+		// The size of stdin is unknown, so the bar runs as a spinner
+		{"unknown size", -1, []string{"100 B", "3 rows", "rows/s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			p := newBarProgress(&out, tt.total, time.Millisecond)
+			p.Write(make([]byte, 60))
+			p.Row()
+			p.Row()
+			p.Write(make([]byte, 40))
+			p.Row()
+			if err := p.Finish(); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("bar %q doesn't show %q", out.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	tests := []struct {
+		name  string
+		total int64
+		want  string
+	}{
+		{"known size", 100, `{"processed":100,"total":100,"rows":3}`},
+		{"unknown size", -1, `{"processed":100,"rows":3}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			// Only the final report is written within the interval
+			p := newJSONProgress(&out, tt.total, time.Hour)
+			p.Write(make([]byte, 60))
+			p.Row()
+			p.Row()
+			p.Write(make([]byte, 40))
+			p.Row()
+			if err := p.Finish(); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSuffix(out.String(), "\n"); got != tt.want {
+				t.Errorf("report = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONProgressInterval(t *testing.T) {
+	var out bytes.Buffer
+	p := newJSONProgress(&out, 10, time.Millisecond)
+	p.Write(make([]byte, 10))
+	time.Sleep(20 * time.Millisecond)
+	if err := p.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("got %d reports, want periodic ones before the final one", len(lines))
+	}
+	for _, line := range lines {
+		var report struct{ Processed, Total, Rows int64 }
+		if err := json.Unmarshal([]byte(line), &report); err != nil {
+			t.Fatalf("report %q: %v", line, err)
+		}
+		if report.Processed != 10 || report.Total != 10 {
+			t.Errorf("report %q, want 10 of 10 bytes processed", line)
+		}
+	}
+}
+
+func TestPartitionFiles(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gzip=%t", gzipped), func(t *testing.T) {
+			dir := t.TempDir()
+			files := &partitionFiles{max: 2}
+			var outputs []*partitionFile
+			for _, name := range []string{"a", "b", "c"} {
+				f, err := files.create(filepath.Join(dir, name), gzipped, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				outputs = append(outputs, f)
+			}
+			// Creating c closed a, the least recently written; writing to a
+			// reopens it and closes b
+			for i, f := range []int{2, 0, 2, 1, 0, 1} {
+				fmt.Fprintf(outputs[f], "%d\n", i)
+				if files.open > files.max {
+					t.Fatalf("%d files open, want at most %d", files.open, files.max)
+				}
+			}
+			for _, f := range outputs {
+				if err := f.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if err := f.commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want := map[string]string{"a": "1\n4\n", "b": "3\n5\n", "c": "0\n2\n"}
+			for name, content := range want {
+				data, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if gzipped {
+					// Each reopening starts another gzip member
+					r, err := gzip.NewReader(bytes.NewReader(data))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if data, err = io.ReadAll(r); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if string(data) != content {
+					t.Errorf("%s = %q, want %q", name, data, content)
+				}
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		code   int
+		stdout string
+		// stderr lists text the status output must contain
+		stderr []string
+		// quiet requires stderr to be empty
+		quiet bool
+	}{
+		{
+			name:   "header keys are lower-cased",
+			stdin:  "ID,First Name\n1,Ann\n",
+			stdout: `{"first name":"Ann","id":"1"}` + "\n",
+			stderr: []string{"Conversion complete!", "Rows written:    1"},
+		},
+		{
+			name:   "original key case",
+			args:   []string{"--key-case", "original"},
+			stdin:  "ID,First Name\n1,Ann\n",
+			stdout: `{"First Name":"Ann","ID":"1"}` + "\n",
+		},
+		{
+			name:   "field counts differing from the header",
+			args:   []string{"--ordered"},
+			stdin:  "a,b\n1,2,3\n4\n5,6\n",
+			stdout: `{"a":"1","b":"2"}` + "\n" + `{"a":"4","b":null}` + "\n" + `{"a":"5","b":"6"}` + "\n",
+			stderr: []string{"Warning: stdin row 1: expected 2 fields, got 3", "Warning: stdin row 2: expected 2 fields, got 1"},
+		},
+		{
+			name:   "field count mismatch with --strict",
+			args:   []string{"--strict"},
+			stdin:  "a,b\n1,2,3\n",
+			code:   1,
+			stderr: []string{"Error converting CSV: stdin row 1: expected 2 fields, got 3", "Result:          failed"},
+		},
+		{
+			name:   "quoted newlines",
+			args:   []string{"--ordered"},
+			stdin:  "id,text\n1,\"a\nb\"\n2,c\n",
+			stdout: `{"id":"1","text":"a\nb"}` + "\n" + `{"id":"2","text":"c"}` + "\n",
+		},
+		{
+			name:   "CRLF line endings",
+			args:   []string{"--ordered"},
+			stdin:  "id,text\r\n1,\"a\r\nb\"\r\n2,c\r\n",
+			stdout: `{"id":"1","text":"a\nb"}` + "\n" + `{"id":"2","text":"c"}` + "\n",
+		},
+		{
+			name:   "json-array with inferred types",
+			args:   []string{"--format", "json-array", "--ordered", "--infer-types"},
+			stdin:  "id,score,ok\n1,2.5,true\n2,,false\n",
+			stdout: "[\n" + `{"id":1,"ok":true,"score":2.5}` + ",\n" + `{"id":2,"ok":false,"score":""}` + "\n]\n",
+		},
+		{
+			name:   "header only",
+			args:   []string{"--format", "json-array"},
+			stdin:  "a,b\n",
+			stdout: "[]\n",
+			stderr: []string{"Conversion complete!", "Rows read:       0"},
+		},
+		{
+			name:   "empty input",
+			args:   []string{"--format", "json-array"},
+			stdout: "[]\n",
+			stderr: []string{"Warning: stdin: input is empty; no rows to convert"},
+		},
+		{
+			name:   "--quiet leaves stderr empty",
+			args:   []string{"--quiet"},
+			stdin:  "a\n1\n",
+			stdout: `{"a":"1"}` + "\n",
+			quiet:  true,
+		},
+		{
+			name:   "explicit zero workers",
+			args:   []string{"--workers", "0"},
+			stdin:  "a\n1\n",
+			code:   2,
+			stderr: []string{"Invalid --workers value: must be at least 1, got 0"},
+		},
+		{
+			name:   "unknown flag",
+			args:   []string{"--no-such-flag"},
+			code:   2,
+			stderr: []string{"flag provided but not defined: -no-such-flag", "Usage:"},
+		},
+		{
+			name:   "help",
+			args:   []string{"-h"},
+			stderr: []string{"Usage:", "-workers"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(append([]string{"--progress", "none"}, tt.args...), strings.NewReader(tt.stdin), &stdout, &stderr)
+			if code != tt.code {
+				t.Errorf("exit status = %d, want %d; stderr:\n%s", code, tt.code, stderr.String())
+			}
+			if stdout.String() != tt.stdout {
+				t.Errorf("stdout = %q, want %q", stdout.String(), tt.stdout)
+			}
+			for _, want := range tt.stderr {
+				if !strings.Contains(stderr.String(), want) {
+					t.Errorf("stderr doesn't contain %q:\n%s", want, stderr.String())
+				}
+			}
+			if tt.quiet && stderr.Len() > 0 {
+				t.Errorf("stderr = %q, want it empty", stderr.String())
+			}
+		})
+	}
+}
+
+func TestBuildOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+		// err is the message reported, when the flags are refused
+		err string
+	}{
+		{"defaults", nil, 0, ""},
+		{"append without output", []string{"--append"}, 2, "Invalid --append value: requires --output"},
+		{"append to csv", []string{"--append", "--output", "out.csv", "--format", "csv"}, 2, "Invalid --append value: requires --format jsonl, got csv"},
+		{"parquet gzipped", []string{"--format", "parquet", "--output", "out.parquet", "--gzip-out"}, 2, "Invalid --format value: parquet can't be combined with"},
+		{"sqlite without table", []string{"--sqlite", "out.db"}, 2, "Invalid --sqlite value: --sqlite and --table must be given together"},
+		{"sqlite with output", []string{"--sqlite", "out.db", "--table", "rows", "--output", "out.json"}, 2, "Invalid --sqlite value: can't be combined with --output"},
+		{"strict columns alone", []string{"--strict-columns"}, 2, "Invalid --strict-columns value: requires --require-columns"},
+		{"pretty csv", []string{"--pretty", "--format", "csv"}, 2, "Invalid --pretty value: requires --format jsonl or json-array, got csv"},
+		{"pretty batches", []string{"--pretty", "--batch-size", "10"}, 2, "Invalid --pretty value: can't be combined with --batch-size"},
+		{"zero workers", []string{"--workers", "0"}, 2, "Invalid --workers value: must be at least 1, got 0"},
+		{"split lines to stdout", []string{"--split-lines", "10"}, 2, "Invalid --split-lines value: requires --output"},
+		{"output url with output", []string{"--output-url", "http://localhost/", "--output", "out.json"}, 2, "Invalid --output-url value: can't be combined with"},
+		{"partitions to stdout", []string{"--partition-by", "a"}, 2, "Invalid --partition-by value: requires --output"},
+		{"trailer on csv", []string{"--with-trailer", "--format", "csv"}, 2, "Invalid --with-trailer value: can't be combined with --format csv"},
+		{"output dir and template", []string{"--output-dir", "out", "--output-template", "{name}.json"}, 2, "Invalid --output-dir value: can't be combined with --output-template"},
+		{"widths and split regex", []string{"--widths", "1,2", "--split-regex", ","}, 2, "Invalid --widths value: can't be combined with --split-regex"},
+		{"comment char is the delimiter", []string{"--comment-char", ","}, 2, "Invalid --comment-char value: must differ from the delimiter"},
+		{"columns file and headers", []string{"--columns-file", "cols.txt", "--headers", "a"}, 2, "Invalid --columns-file value: can't be combined with --headers"},
+		{"missing file", []string{"--file", "no-such-file-*.csv"}, 1, "no-such-file-*.csv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, f := newFlags(io.Discard)
+			if err := parseFlags(flags, f, tt.args); err != nil {
+				t.Fatal(err)
+			}
+			_, code, err := buildOptions(f, strings.NewReader(""))
+			if code != tt.code {
+				t.Errorf("exit status = %d, want %d (error %v)", code, tt.code, err)
+			}
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("error = %v, want none", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error = %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBuildOptionsDefaults(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.csv", "b.csv"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("a\n1\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flags, f := newFlags(io.Discard)
+	args := []string{"--file", filepath.Join(dir, "*.csv"), "--format", "pretty-array", "--output", "out.json.gz", "--infer-schema"}
+	if err := parseFlags(flags, f, args); err != nil {
+		t.Fatal(err)
+	}
+	opts, _, err := buildOptions(f, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Format != converter.FormatJSONArray || opts.Indent != "  " {
+		t.Errorf("format = %q, indent = %q, want an indented json-array", opts.Format, opts.Indent)
+	}
+	if !opts.InferTypes {
+		t.Error("--infer-schema didn't turn on type inference")
+	}
+	// Rows from several files say where they came from
+	if len(f.paths) != 2 || opts.SourceKey != "_source" {
+		t.Errorf("paths = %q, source key = %q, want two files tagged with _source", f.paths, opts.SourceKey)
+	}
+	if !f.gzipOut {
+		t.Error("an output ending in .gz isn't gzipped")
+	}
+}
+
+func TestRunOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.csv")
+	if err := os.WriteFile(input, []byte("id,name\n1,Ann\n2,Bob\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "out.json")
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"--file", input, "--output", output, "--format", "pretty-array", "--ordered", "--quiet"}, strings.NewReader(""), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit status = %d; stderr:\n%s", code, stderr.String())
+	}
+	if stdout.Len() > 0 || stderr.Len() > 0 {
+		t.Errorf("stdout = %q, stderr = %q, want both empty", stdout.String(), stderr.String())
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []map[string]string
+	if err := json.Unmarshal(data, &rows); err != nil {
+		t.Fatalf("output isn't a JSON array: %v\n%s", err, data)
+	}
+	if want := []map[string]string{{"id": "1", "name": "Ann"}, {"id": "2", "name": "Bob"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %v, want %v", rows, want)
+	}
+	// Nothing is left behind but the input and the output
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("directory holds %d files, want 2", len(entries))
+	}
+}
+
+func TestRunAppend(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "out.jsonl")
+	existing := `{"id":"0"}` + "\n"
+	if err := os.WriteFile(output, []byte(existing), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--output", output, "--append", "--ordered", "--strict", "--quiet", "--progress", "none"}
+	// The rows read before the failing one aren't added either
+	var stderr bytes.Buffer
+	if code := run(args, strings.NewReader("id\n1\n2\n3,4\n"), io.Discard, &stderr); code != 1 {
+		t.Fatalf("exit status = %d, want 1; stderr:\n%s", code, stderr.String())
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != existing {
+		t.Errorf("after a failed run, output = %q, want %q", data, existing)
+	}
+
+	stderr.Reset()
+	if code := run(args, strings.NewReader("id\n1\n2\n"), io.Discard, &stderr); code != 0 {
+		t.Fatalf("exit status = %d; stderr:\n%s", code, stderr.String())
+	}
+	data, err = os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := existing + `{"id":"1"}` + "\n" + `{"id":"2"}` + "\n"; string(data) != want {
+		t.Errorf("output = %q, want %q", data, want)
+	}
+	// The staged rows were removed once added
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want 1", len(entries))
+	}
+}
+
+func TestParquetHeaderOnly(t *testing.T) {
+	var out bytes.Buffer
+	p := newParquetFile(&out)
+	opts := converter.Options{Workers: 1, Sink: p.add, Header: p.setHeader, KeyCase: converter.KeyCaseLower, InferTypes: true}
+	if _, err := converter.Convert(context.Background(), strings.NewReader("ID,Name,score\n"), io.Discard, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.NumRows() != 0 {
+		t.Errorf("file has %d rows, want 0", file.NumRows())
+	}
+	var columns []string
+	for _, field := range file.Schema().Fields() {
+		columns = append(columns, field.Name())
+		if field.Type().Kind() != parquet.ByteArray || !field.Optional() {
+			t.Errorf("column %s is %v, want an optional string", field.Name(), field.Type())
+		}
+	}
+	if want := []string{"id", "name", "score"}; !reflect.DeepEqual(columns, want) {
+		t.Errorf("columns = %q, want %q", columns, want)
+	}
+}
+
+func TestSQLiteHeaderOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.db")
+	table, err := openSQLiteTable(path, "people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := converter.Options{Workers: 1, Sink: table.insert, Header: table.setHeader, KeyCase: converter.KeyCaseLower, InferTypes: true}
+	if _, err := converter.Convert(context.Background(), strings.NewReader("ID,Name,score\n"), io.Discard, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT name, type FROM pragma_table_info('people') ORDER BY cid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			t.Fatal(err)
+		}
+		columns = append(columns, name+" "+typ)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"id TEXT", "name TEXT", "score TEXT"}; !reflect.DeepEqual(columns, want) {
+		t.Errorf("columns = %q, want %q", columns, want)
+	}
+}
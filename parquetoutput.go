@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// formatParquet is the --format value that writes a Parquet file. It isn't
+// one of the converter's formats: rows go to a parquetFile as the sink.
+const formatParquet = "parquet"
+
+// parquetSampleRows is how many rows --format parquet holds back to choose
+// the column types before writing any.
+const parquetSampleRows = 1000
+
+// parquetFile is the output for --format parquet. Parquet needs its schema
+// before the first row, so the first rows are held back and their types
+// collected as for --infer-schema; once parquetSampleRows have been seen, or
+// the input ends, the schema is fixed and rows are written as they arrive.
+// Rows come from the converter's single writing goroutine, so no locking is
+// needed. As with --sqlite, keys a later source doesn't have are written as
+// null and ones it adds are dropped. An input with a header but no rows gets
+// a file of the header's columns, as strings, and no rows.
+type parquetFile struct {
+	out     io.Writer
+	sample  *schemaInferrer
+	pending []map[string]interface{}
+
+	// header holds the first source's keys. It is set by the converter's
+	// readers, hence the lock.
+	headerMu sync.Mutex
+	header   []string
+
+	writer  *parquet.Writer
+	columns []string
+	types   []string
+	row     parquet.Row
+}
+
+func newParquetFile(out io.Writer) *parquetFile {
+	return &parquetFile{out: out, sample: newSchemaInferrer()}
+}
+
+func (p *parquetFile) add(fields []string, row map[string]interface{}) error {
+	if p.writer != nil {
+		return p.write(row)
+	}
+	if err := p.sample.add(fields, row); err != nil {
+		return err
+	}
+	p.pending = append(p.pending, row)
+	if len(p.pending) < parquetSampleRows {
+		return nil
+	}
+	return p.begin()
+}
+
+// setHeader records the keys of a source's rows, unless an earlier source's
+// were recorded.
+func (p *parquetFile) setHeader(source string, fields []string) {
+	p.headerMu.Lock()
+	defer p.headerMu.Unlock()
+	if p.header == nil {
+		p.header = fields
+	}
+}
+
+// begin fixes the schema from the rows seen so far and writes them.
+func (p *parquetFile) begin() error {
+	columns := p.sample.columns
+	typeOf := func(key string) string { return parquetType(p.sample.seen[key].schemaType()) }
+	if len(columns) == 0 {
+		// With no rows to go by, every column is text
+		p.headerMu.Lock()
+		columns = p.header
+		p.headerMu.Unlock()
+		typeOf = func(string) string { return "string" }
+	}
+	if len(columns) == 0 {
+		return errors.New("no header or rows to take the Parquet columns from")
+	}
+	group := make(parquet.Group, len(columns))
+	types := make(map[string]string, len(columns))
+	for _, key := range columns {
+		typ := typeOf(key)
+		types[key] = typ
+		switch typ {
+		case "integer":
+			group[key] = parquet.Optional(parquet.Int(64))
+		case "number":
+			group[key] = parquet.Optional(parquet.Leaf(parquet.DoubleType))
+		case "boolean":
+			group[key] = parquet.Optional(parquet.Leaf(parquet.BooleanType))
+		default:
+			group[key] = parquet.Optional(parquet.String())
+		}
+	}
+	schema := parquet.NewSchema("row", group)
+	// The schema orders columns by name
+	for _, path := range schema.Columns() {
+		p.columns = append(p.columns, path[0])
+		p.types = append(p.types, types[path[0]])
+	}
+	p.row = make(parquet.Row, len(p.columns))
+	p.writer = parquet.NewWriter(p.out, schema, parquet.Compression(&parquet.Snappy))
+
+	for _, row := range p.pending {
+		if err := p.write(row); err != nil {
+			return err
+		}
+	}
+	p.pending = nil
+	return nil
+}
+
+// parquetType is the type a column is written as, from its schemaType:
+// integer, number, boolean, or else string, with anything that isn't a
+// scalar written as JSON text.
+func parquetType(schemaType interface{}) string {
+	typ, ok := schemaType.(string)
+	if !ok {
+		// A nullable type is listed with "null"; every column is optional
+		typ = schemaType.([]string)[0]
+	}
+	switch typ {
+	case "integer", "number", "boolean":
+		return typ
+	}
+	return "string"
+}
+
+func (p *parquetFile) write(row map[string]interface{}) error {
+	for i, column := range p.columns {
+		value, err := parquetValue(row[column], p.types[i])
+		if err != nil {
+			return fmt.Errorf("column %q: %w", column, err)
+		}
+		if row[column] == nil {
+			p.row[i] = value.Level(0, 0, i)
+		} else {
+			p.row[i] = value.Level(0, 1, i)
+		}
+	}
+	_, err := p.writer.WriteRows([]parquet.Row{p.row})
+	return err
+}
+
+func parquetValue(value interface{}, typ string) (parquet.Value, error) {
+	if value == nil {
+		return parquet.NullValue(), nil
+	}
+	switch v := value.(type) {
+	case string:
+		switch typ {
+		case "string":
+			return parquet.ByteArrayValue([]byte(v)), nil
+		case "number":
+			// Type inference keeps numbers such as 1e-05 or 0.50 as text,
+			// since they wouldn't be written back the same way
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return parquet.DoubleValue(f), nil
+			}
+		}
+	case int64:
+		switch typ {
+		case "integer":
+			return parquet.Int64Value(v), nil
+		case "number":
+			return parquet.DoubleValue(float64(v)), nil
+		}
+	case float64:
+		if typ == "number" {
+			return parquet.DoubleValue(v), nil
+		}
+	case bool:
+		if typ == "boolean" {
+			return parquet.BooleanValue(v), nil
+		}
+	}
+	if typ != "string" {
+		return parquet.Value{}, fmt.Errorf("%v doesn't fit the %s type chosen from the first %d rows; list the column in --string-columns to keep it as text", value, typ, parquetSampleRows)
+	}
+	data, err := json.Marshal(value)
+	return parquet.ByteArrayValue(data), err
+}
+
+// close writes any rows still held back and the file footer.
+func (p *parquetFile) close() error {
+	if p.writer == nil {
+		if err := p.begin(); err != nil {
+			return err
+		}
+	}
+	return p.writer.Close()
+}
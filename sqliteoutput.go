@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteTable is the output for --sqlite. It receives rows from the
+// converter's single writing goroutine, so the transaction and prepared
+// statement it shares across rows need no locking. The table is created from
+// the first row, if it doesn't exist yet, or when no row arrives from the
+// header of the first source, and every row is inserted in one transaction
+// that is only committed once the whole conversion has succeeded.
+type sqliteTable struct {
+	db      *sql.DB
+	name    string
+	columns []string
+	tx      *sql.Tx
+	stmt    *sql.Stmt
+
+	// The readers record the header while rows are being inserted
+	headerMu sync.Mutex
+	header   []string
+}
+
+func openSQLiteTable(path, name string) (*sqliteTable, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// Rows arrive one at a time and a transaction holds its connection
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteTable{db: db, name: name}, nil
+}
+
+// insert adds a row, creating the table and starting the transaction with
+// the first one. Columns are those of the first row; keys a later source
+// doesn't have are inserted as NULL and ones it adds are dropped.
+func (t *sqliteTable) insert(fields []string, row map[string]interface{}) error {
+	if t.stmt == nil {
+		if err := t.begin(fields, row); err != nil {
+			return err
+		}
+	}
+	args := make([]interface{}, len(t.columns))
+	for i, column := range t.columns {
+		value, err := sqliteValue(row[column])
+		if err != nil {
+			return err
+		}
+		args[i] = value
+	}
+	if _, err := t.stmt.Exec(args...); err != nil {
+		return fmt.Errorf("inserting into %s: %w", t.name, err)
+	}
+	return nil
+}
+
+// setHeader records the keys of a source's rows, unless an earlier source's
+// were recorded.
+func (t *sqliteTable) setHeader(source string, fields []string) {
+	t.headerMu.Lock()
+	defer t.headerMu.Unlock()
+	if t.header == nil {
+		t.header = fields
+	}
+}
+
+// begin creates the table with the given columns, typed by the values of
+// row, and starts the transaction. With a nil row every column is TEXT.
+func (t *sqliteTable) begin(fields []string, row map[string]interface{}) error {
+	definitions := make([]string, len(fields))
+	placeholders := make([]string, len(fields))
+	for i, column := range fields {
+		definitions[i] = quoteIdent(column)
+		affinity := "TEXT"
+		if row != nil {
+			affinity = sqliteAffinity(row[column])
+		}
+		if affinity != "" {
+			definitions[i] += " " + affinity
+		}
+		placeholders[i] = "?"
+	}
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quoteIdent(t.name), strings.Join(definitions, ", "))
+	if _, err := tx.Exec(create); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("creating table %s: %w", t.name, err)
+	}
+	quoted := make([]string, len(fields))
+	for i, column := range fields {
+		quoted[i] = quoteIdent(column)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdent(t.name), strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+	stmt, err := tx.Prepare(insert)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("preparing insert into %s: %w", t.name, err)
+	}
+	t.columns, t.tx, t.stmt = fields, tx, stmt
+	return nil
+}
+
+// commit commits the rows inserted so far and closes the database. Without
+// any rows, the table is created from the header, so that loading an empty
+// file still leaves a table to query.
+func (t *sqliteTable) commit() error {
+	t.headerMu.Lock()
+	header := t.header
+	t.headerMu.Unlock()
+	var err error
+	if t.tx == nil && len(header) > 0 {
+		err = t.begin(header, nil)
+	}
+	if t.tx != nil {
+		t.stmt.Close()
+		err = t.tx.Commit()
+	}
+	if closeErr := t.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// discard rolls back every row of a failed conversion and closes the
+// database.
+func (t *sqliteTable) discard() {
+	if t.tx != nil {
+		t.stmt.Close()
+		t.tx.Rollback()
+	}
+	t.db.Close()
+}
+
+// sqliteAffinity picks a column's type from the first row's value, which
+// only varies with --infer-types. Without a value to go by the column is
+// left without a declared type.
+func sqliteAffinity(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case int64, bool:
+		return "INTEGER"
+	case float64:
+		return "REAL"
+	default:
+		return "TEXT"
+	}
+}
+
+// sqliteValue converts a row value to one SQLite can store. Nested objects
+// and lists are stored as JSON text.
+func sqliteValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, int64, float64, bool:
+		return v, nil
+	default:
+		data, err := json.Marshal(v)
+		return string(data), err
+	}
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}